@@ -0,0 +1,53 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// threads runs plenty of yielding work for each of a few keys, and returns the threads each key's work ran on
+func threads(sut *Workpool) map[string]map[int]bool {
+	var mtx sync.Mutex
+	seen := map[string]map[int]bool{}
+	// held until everything is queued, so that no key runs dry and goes idle, losing its thread
+	sut.PauseAll()
+	for i := 0; i < 400; i++ {
+		key := strconv.Itoa(i % 8)
+		sut.Submit(wrk{k: key, d: func() {
+			// give the scheduler a chance to move the goroutine between threads
+			runtime.Gosched()
+			time.Sleep(10 * time.Microsecond)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if seen[key] == nil {
+				seen[key] = map[int]bool{}
+			}
+			seen[key][syscall.Gettid()] = true
+		}})
+	}
+	sut.ResumeAll()
+	sut.Wait()
+	return seen
+}
+
+func TestThreadAffinity(t *testing.T) {
+	for name, sut := range map[string]*Workpool{
+		"managers": New(WithThreadAffinity(), WithIdleTimeout(time.Second)),
+		// the completion callback would otherwise stop the manager running its key's work itself
+		"callbacks": New(WithThreadAffinity(), WithIdleTimeout(time.Second), WithOnComplete(func(string, time.Duration) {})),
+		"shards":    New(WithThreadAffinity(), WithShards(2)),
+	} {
+		seen := threads(sut)
+		assert.Len(t, seen, 8, name)
+		for key, tids := range seen {
+			assert.Len(t, tids, 1, "%s: key %s ran on threads %v", name, key, tids)
+		}
+		assert.NoError(t, sut.Shutdown(context.Background()))
+	}
+}
@@ -0,0 +1,36 @@
+package workpool
+
+import (
+	"time"
+)
+
+// KeyedAuditRecord describes an item which has finished running, for an audit trail of the order in which work ran
+// (see WithAuditSink)
+type KeyedAuditRecord[K comparable] struct {
+	Key K
+	// the item's sequence number, which is unique to the workpool and increases with every item queued, across all keys.
+	// A Queue from WithQueueFactory holds only work, so the sequence number and enqueue time of work it held are zero
+	Seq uint64
+	// when the item was queued
+	EnqueuedAt time.Time
+	// when the item's Do was called, and when it returned.  For a retried ErrWork, those of its last attempt
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// AuditRecord is a KeyedAuditRecord for string keys
+type AuditRecord = KeyedAuditRecord[string]
+
+// audit hands the record of the finished item to the audit sink, if there is one
+func (wp *KeyedWorkpool[K]) audit(key K, e entry[K], started, finished time.Time) {
+	if wp.hooks.auditSink == nil {
+		return
+	}
+	wp.hooks.auditSink(KeyedAuditRecord[K]{
+		Key:        key,
+		Seq:        e.seq,
+		EnqueuedAt: e.enqueued,
+		StartedAt:  started,
+		FinishedAt: finished,
+	})
+}
@@ -0,0 +1,42 @@
+package workpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestAuditSink(t *testing.T) {
+	var mtx sync.Mutex
+	records := map[string][]AuditRecord{}
+	sut := New(WithAuditSink(func(r AuditRecord) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		records[r.Key] = append(records[r.Key], r)
+	}))
+	for i := 0; i < 100; i++ {
+		sut.Submit(wrk{k: strconv.Itoa(i % 4), d: func() {}})
+	}
+	sut.Wait()
+
+	var seqs []uint64
+	for key, rs := range records {
+		assert.Len(t, rs, 25, key)
+		for i, r := range rs {
+			assert.False(t, r.StartedAt.Before(r.EnqueuedAt))
+			assert.False(t, r.FinishedAt.Before(r.StartedAt))
+			if i > 0 {
+				// each key's work ran in the order it was queued
+				assert.Greater(t, r.Seq, rs[i-1].Seq, key)
+			}
+			seqs = append(seqs, r.Seq)
+		}
+	}
+	// and every item has a sequence number of its own
+	var want []uint64
+	for i := uint64(1); i <= 100; i++ {
+		want = append(want, i)
+	}
+	assert.ElementsMatch(t, want, seqs)
+}
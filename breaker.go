@@ -0,0 +1,62 @@
+package workpool
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a key's circuit breaker (see WithCircuitBreaker).  It's closed while failures is below the threshold, open
+// until openUntil once it's reached, and half-open after that: the next item is let through, and its outcome either
+// closes the breaker or opens it again
+type breaker struct {
+	mtx sync.Mutex
+	// consecutive failures of the key's work
+	failures int
+	// when the breaker half-opens.  Zero while the breaker is closed
+	openUntil time.Time
+}
+
+// open returns whether work must be failed fast
+func (b *breaker) open() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return !b.openUntil.IsZero() && time.Now().Before(b.openUntil)
+}
+
+// fail records a failure, and opens the breaker if it's one too many
+func (b *breaker) fail(threshold int, cooldown time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// tripped returns whether the key's breaker is open, reporting the work as failed if so
+func (wp *KeyedWorkpool[K]) tripped(key K) bool {
+	if wp.cfg.breakerThreshold <= 0 {
+		return false
+	}
+	b, ok := wp.breakers.Load(key)
+	if !ok || !b.(*breaker).open() {
+		return false
+	}
+	wp.debug("workpool: work failed fast by the circuit breaker", key)
+	wp.report(key, ErrCircuitOpen)
+	return true
+}
+
+// recordOutcome updates the key's breaker with the outcome of its work.  A key's breaker only exists while it has
+// failures, so a healthy key costs nothing.  The key must still be locked, so that its next item sees the outcome
+func (wp *KeyedWorkpool[K]) recordOutcome(key K, err error) {
+	if wp.cfg.breakerThreshold <= 0 {
+		return
+	}
+	if err == nil {
+		wp.breakers.Delete(key)
+		return
+	}
+	b, _ := wp.breakers.LoadOrStore(key, &breaker{})
+	b.(*breaker).fail(wp.cfg.breakerThreshold, wp.cfg.breakerCooldown)
+}
@@ -0,0 +1,78 @@
+package workpool
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrWorkCancelled is what a Result completes with when its work was cancelled before it started (see Submit)
+var ErrWorkCancelled = errors.New("workpool: work cancelled")
+
+// the states of a handle.  A handle leaves queued exactly once: either its work is cancelled, or it starts, or it's
+// dropped or replaced without running
+const (
+	handleQueued uint32 = iota
+	handleCancelled
+	handleStarted
+	handleDropped
+)
+
+// handle lets the submitter of queued work cancel it, until it starts (see Submit)
+type handle struct {
+	state uint32
+}
+
+// cancel marks the work as cancelled, and returns true, unless it has already started or been cancelled
+func (h *handle) cancel() bool {
+	return h != nil && atomic.CompareAndSwapUint32(&h.state, handleQueued, handleCancelled)
+}
+
+// cancelled returns whether the work has been cancelled
+func (h *handle) cancelled() bool {
+	return h != nil && atomic.LoadUint32(&h.state) == handleCancelled
+}
+
+// drop marks the work as dropped or replaced without running, so that there's nothing left to cancel
+func (h *handle) drop() {
+	if h != nil {
+		atomic.CompareAndSwapUint32(&h.state, handleQueued, handleDropped)
+	}
+}
+
+// start marks the work as started, so that it can no longer be cancelled, and returns true, unless it has been
+// cancelled.  Work without a handle always starts, as does retried work, which has started already
+func (h *handle) start() bool {
+	if h == nil || atomic.CompareAndSwapUint32(&h.state, handleQueued, handleStarted) {
+		return true
+	}
+	return atomic.LoadUint32(&h.state) == handleStarted
+}
+
+// canceller returns the Cancel func handed back by Submit for the work.  Cancelled work is taken out of its key's queue
+// straight away if it can be, and finished without running.  Otherwise, as with a Queue from WithQueueFactory, it's
+// left in place and dropped once it reaches the head of the queue
+func (wp *KeyedWorkpool[K]) canceller(key K, h *handle) func() bool {
+	return func() bool {
+		if !h.cancel() {
+			return false
+		}
+		wp.submitMtx.Lock()
+		defer wp.submitMtx.Unlock()
+		p, ok := wp.pool.Load(key)
+		if !ok {
+			// the work was dropped along with its key, or the manager has it already
+			return true
+		}
+		wq, ok := p.(*workQueue[K])
+		if !ok {
+			return true
+		}
+		if e, ok := wq.remove(h); ok {
+			// if the manager has already seen the work, it will find the queue without it
+			e.result.complete(ErrWorkCancelled)
+			pending, _ := wp.pending.Load(key)
+			wp.finish(pending.(*int64), e.work)
+		}
+		return true
+	}
+}
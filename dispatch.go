@@ -0,0 +1,159 @@
+package workpool
+
+import (
+	"context"
+	"sync"
+)
+
+// slotLimiter limits how many items may run at once across all keys.  It's satisfied by *semaphore.Weighted, which
+// grants slots strictly in the order they're asked for, and by *dispatcher for WithFairDispatch
+type slotLimiter interface {
+	// Acquire blocks until n slots are granted, or ctx is done
+	Acquire(ctx context.Context, n int64) error
+	// Release returns n slots
+	Release(n int64)
+}
+
+// dispatcher hands out slots to keys round-robin.  A key runs one item at a time, so it has at most one waiter: once its
+// item is granted and run, the key's next request goes to the back of the line, behind every other key with pending
+// work.  Unlike a semaphore, a waiter too heavy for the free slots doesn't hold up lighter waiters behind it.
+// Waiters in a higher lane (see WithPriorityLanes) are considered before any in a lower lane.  With tenants (see
+// WithTenantFairness), a lane's waiters from the tenant holding the fewest slots are considered first
+type dispatcher struct {
+	mtx  sync.Mutex
+	free int64
+	// how many lanes waiters may be in.  At least 1
+	lanes int
+	// how many slots each tenant holds.  nil unless slots are shared fairly between tenants
+	held map[string]int64
+	// waiters in the order they'll be considered within their lane
+	waiting []*waiter
+}
+
+type waiter struct {
+	n      int64
+	lane   int
+	tenant string
+	// closed once the slots are granted
+	granted chan struct{}
+}
+
+// newDispatcher returns a dispatcher of n slots for waiters in the given number of lanes, which shares the slots fairly
+// between tenants if asked to
+func newDispatcher(n int64, lanes int, tenants bool) *dispatcher {
+	d := &dispatcher{free: n, lanes: max(lanes, 1)}
+	if tenants {
+		d.held = map[string]int64{}
+	}
+	return d
+}
+
+func (d *dispatcher) Acquire(ctx context.Context, n int64) error {
+	return d.acquire(ctx, n, 0, "")
+}
+
+// acquire is Acquire for a waiter in the given lane, on behalf of the given tenant
+func (d *dispatcher) acquire(ctx context.Context, n int64, lane int, tenant string) error {
+	d.mtx.Lock()
+	// nobody waiting fits in the free slots, or they'd have been granted already, so there's nobody to jump ahead of
+	if d.free >= n {
+		d.hold(tenant, n)
+		d.mtx.Unlock()
+		return nil
+	}
+	w := &waiter{n: n, lane: lane, tenant: tenant, granted: make(chan struct{})}
+	d.waiting = append(d.waiting, w)
+	d.mtx.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	select {
+	case <-w.granted:
+		// granted just as the context was done.  Hand the slots on
+		d.hold(tenant, -n)
+		d.grant()
+	default:
+		for i, o := range d.waiting {
+			if o == w {
+				d.waiting = append(d.waiting[:i], d.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (d *dispatcher) Release(n int64) {
+	d.release(n, "")
+}
+
+// release is Release for slots acquired on behalf of the given tenant
+func (d *dispatcher) release(n int64, tenant string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.hold(tenant, -n)
+	d.grant()
+}
+
+// hold takes n slots from the free slots for the tenant, or gives them back if n is negative.  The mutex must be held
+func (d *dispatcher) hold(tenant string, n int64) {
+	d.free -= n
+	if d.held == nil {
+		return
+	}
+	if d.held[tenant] += n; d.held[tenant] <= 0 {
+		delete(d.held, tenant)
+	}
+}
+
+// grant hands the free slots to every waiter they fit, a lane at a time from the highest.  The mutex must be held
+func (d *dispatcher) grant() {
+	granted := 0
+	for lane := d.lanes - 1; lane >= 0 && d.free > 0; lane-- {
+		for w := d.next(lane); w != nil; w = d.next(lane) {
+			d.hold(w.tenant, w.n)
+			close(w.granted)
+			// granted waiters are skipped from here on, and dropped below
+			w.lane = -1
+			granted++
+		}
+	}
+	if granted == 0 {
+		return
+	}
+	waiting := d.waiting[:0]
+	for _, w := range d.waiting {
+		if w.lane >= 0 {
+			waiting = append(waiting, w)
+		}
+	}
+	// clear the tail so that granted waiters can be collected
+	for i := len(waiting); i < len(d.waiting); i++ {
+		d.waiting[i] = nil
+	}
+	d.waiting = waiting
+}
+
+// next returns the waiter in the lane which the free slots should go to next, or nil if none fits.  That's the first to
+// fit, unless tenants share the slots, in which case it's the first to fit of the tenant holding the fewest.  The mutex
+// must be held
+func (d *dispatcher) next(lane int) *waiter {
+	var next *waiter
+	for _, w := range d.waiting {
+		if w.lane != lane || w.n > d.free {
+			continue
+		}
+		if d.held == nil {
+			return w
+		}
+		if next == nil || d.held[w.tenant] < d.held[next.tenant] {
+			next = w
+		}
+	}
+	return next
+}
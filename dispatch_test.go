@@ -0,0 +1,193 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairDispatch(t *testing.T) {
+	sut := New(WithMaxConcurrency(2), WithFairDispatch())
+	block := make(chan struct{})
+	for _, key := range []string{"hot1", "hot2"} {
+		for i := 0; i < 500; i++ {
+			sut.Submit(wrk{k: key, d: func() {
+				select {
+				case <-block:
+				case <-time.After(time.Millisecond):
+				}
+			}})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		sut.Submit(wrk{k: strconv.Itoa(i), d: wg.Done})
+	}
+
+	// the sparse keys each get a turn long before the floods are through
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sparse keys starved")
+	}
+	assert.Greater(t, sut.KeyQueueLen("hot1")+sut.KeyQueueLen("hot2"), 900)
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestDispatcher(t *testing.T) {
+	d := newDispatcher(3, 1, false)
+	ctx := context.Background()
+	assert.NoError(t, d.Acquire(ctx, 2))
+
+	heavy := make(chan error)
+	go func() {
+		heavy <- d.Acquire(ctx, 3)
+	}()
+	assert.Eventually(t, func() bool {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		return len(d.waiting) == 1
+	}, time.Second, time.Millisecond)
+
+	// a lighter request isn't held up behind the heavy one
+	assert.NoError(t, d.Acquire(ctx, 1))
+	// and a cancelled one gives up its place
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, d.Acquire(cancelled, 1), context.Canceled)
+
+	d.Release(2)
+	select {
+	case err := <-heavy:
+		t.Fatalf("heavy request granted early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Release(1)
+	assert.NoError(t, <-heavy)
+	assert.Empty(t, d.waiting)
+	assert.Equal(t, int64(0), d.free)
+}
+
+type lanedWrk struct {
+	wrk
+	lane int
+}
+
+func (w lanedWrk) Lane() int {
+	return w.lane
+}
+
+func TestPriorityLanes(t *testing.T) {
+	sut := New(WithMaxConcurrency(1), WithPriorityLanes(2))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "running", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+
+	var ran []string
+	item := func(key, name string, lane int) lanedWrk {
+		return lanedWrk{wrk: wrk{k: key, d: func() { ran = append(ran, name) }}, lane: lane}
+	}
+	sut.Submit(item("a", "a low", 0))
+	sut.Submit(item("a", "a high", 1))
+	// wait for a's head to be waiting for the slot before b's
+	time.Sleep(10 * time.Millisecond)
+	sut.Submit(item("b", "b high", 1))
+	time.Sleep(10 * time.Millisecond)
+
+	close(block)
+	sut.Wait()
+	// b jumps ahead of a, whose high lane item still waits behind its low lane one
+	assert.Equal(t, []string{"b high", "a low", "a high"}, ran)
+}
+
+type tenantedWrk struct {
+	wrk
+	tenant string
+}
+
+func (w tenantedWrk) Tenant() string {
+	return w.tenant
+}
+
+func TestTenantFairness(t *testing.T) {
+	sut := New(WithMaxConcurrency(4), WithTenantFairness())
+	var noisy, quiet int64
+	var wg sync.WaitGroup
+	item := func(tenant string, key int, done *int64) tenantedWrk {
+		wg.Add(1)
+		return tenantedWrk{wrk: wrk{k: tenant + strconv.Itoa(key), d: func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(done, 1)
+		}}, tenant: tenant}
+	}
+	// the noisy tenant floods five times as many keys
+	for i := 0; i < 50; i++ {
+		for key := 0; key < 20; key++ {
+			sut.Submit(item("noisy", key, &noisy))
+		}
+	}
+	var quietDone sync.WaitGroup
+	quietDone.Add(100)
+	for i := 0; i < 25; i++ {
+		for key := 0; key < 4; key++ {
+			w := item("quiet", key, &quiet)
+			d := w.d
+			w.d = func() {
+				d()
+				quietDone.Done()
+			}
+			sut.Submit(w)
+		}
+	}
+	quietDone.Wait()
+
+	// round-robin across keys would have given the noisy tenant five slots for every one of the quiet tenant's
+	assert.Equal(t, int64(100), atomic.LoadInt64(&quiet))
+	assert.Less(t, atomic.LoadInt64(&noisy), int64(200))
+	wg.Wait()
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestOnStarvation(t *testing.T) {
+	starved := make(chan string, 10)
+	sut := New(WithMaxConcurrency(1), WithOnStarvation(10*time.Millisecond, func(key string, waited time.Duration) {
+		assert.GreaterOrEqual(t, waited, 10*time.Millisecond)
+		starved <- key
+	}))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "hog", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	sut.Submit(wrk{k: "starved", d: func() {}})
+
+	select {
+	case key := <-starved:
+		assert.Equal(t, "starved", key)
+	case <-time.After(time.Second):
+		t.Fatal("starvation went undetected")
+	}
+	close(block)
+	sut.Wait()
+	// the hog never waited
+	assert.Empty(t, starved)
+	assert.Equal(t, uint64(1), sut.Stats().Starvations)
+}
@@ -0,0 +1,78 @@
+package workpool
+
+import (
+	"strconv"
+	"time"
+)
+
+// EventType identifies what happened in a lifecycle Event
+type EventType int
+
+const (
+	// KeySeen is emitted when a key is set up, on its first submission or its first since going idle
+	KeySeen EventType = iota
+	// ManagerStarted is emitted when a key's management goroutine starts
+	ManagerStarted
+	// ManagerStopped is emitted when a key's management goroutine exits idle
+	ManagerStopped
+	// ItemStarted is emitted just before an item's Do is called
+	ItemStarted
+	// ItemCompleted is emitted once an item's Do has returned
+	ItemCompleted
+	// ItemPanicked is emitted instead of ItemCompleted when an item's Do panics
+	ItemPanicked
+	// ItemDropped is emitted when an item is submitted for a busy key and dropped (see WithDropWhileBusy)
+	ItemDropped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case KeySeen:
+		return "KeySeen"
+	case ManagerStarted:
+		return "ManagerStarted"
+	case ManagerStopped:
+		return "ManagerStopped"
+	case ItemStarted:
+		return "ItemStarted"
+	case ItemCompleted:
+		return "ItemCompleted"
+	case ItemPanicked:
+		return "ItemPanicked"
+	case ItemDropped:
+		return "ItemDropped"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// KeyedEvent is something which happened to a key in a KeyedWorkpool.  They're delivered on the Events channel
+type KeyedEvent[K comparable] struct {
+	Type EventType
+	Key  K
+	// when the event happened
+	Time time.Time
+}
+
+// Event is a KeyedEvent for string keys
+type Event = KeyedEvent[string]
+
+// eventBuffer is the size of the Events channel's buffer
+const eventBuffer = 100
+
+// Events returns the channel on which lifecycle events are delivered, or nil unless the workpool was created with
+// WithEvents.  The channel is buffered, and events are dropped rather than holding up work when the buffer is full.
+// Events for a key are delivered in the order they happened
+func (wp *KeyedWorkpool[K]) Events() <-chan KeyedEvent[K] {
+	return wp.events
+}
+
+// emit delivers an event for the key, unless events are disabled or nobody is keeping up with them
+func (wp *KeyedWorkpool[K]) emit(t EventType, key K) {
+	if wp.events == nil {
+		return
+	}
+	select {
+	case wp.events <- KeyedEvent[K]{Type: t, Key: key, Time: time.Now()}:
+	default:
+	}
+}
@@ -0,0 +1,34 @@
+package workpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	assert.Nil(t, New().Events())
+
+	sut := New(WithEvents(), WithIdleTimeout(time.Millisecond), WithPanicHandler(func(Work, interface{}, []byte) {}))
+	before := time.Now()
+	sut.Submit(wrk{k: "key", d: func() {}})
+	sut.Wait()
+
+	var types []EventType
+	for len(sut.Events()) > 0 {
+		e := <-sut.Events()
+		assert.Equal(t, "key", e.Key)
+		assert.False(t, e.Time.Before(before))
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []EventType{KeySeen, ManagerStarted, ItemStarted, ItemCompleted, ManagerStopped}, types)
+
+	sut.Submit(wrk{k: "key", d: func() { panic("oops") }})
+	sut.Wait()
+	types = nil
+	for len(sut.Events()) > 0 {
+		types = append(types, (<-sut.Events()).Type)
+	}
+	assert.Equal(t, []EventType{KeySeen, ManagerStarted, ItemStarted, ItemPanicked, ManagerStopped}, types)
+	assert.Equal(t, "ItemPanicked", ItemPanicked.String())
+}
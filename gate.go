@@ -0,0 +1,45 @@
+package workpool
+
+import "sync"
+
+// submitGate holds submissions while WithSubmitGate's gate is closed
+type submitGate struct {
+	mtx sync.Mutex
+	// broadcast by NotifyGateChanged
+	changed *sync.Cond
+}
+
+func newSubmitGate() *submitGate {
+	g := &submitGate{}
+	g.changed = sync.NewCond(&g.mtx)
+	return g
+}
+
+// NotifyGateChanged tells the workpool that the gate given to WithSubmitGate may have opened, so that submissions held
+// by it check it again.  It does nothing without a gate
+func (wp *KeyedWorkpool[K]) NotifyGateChanged() {
+	if wp.gate == nil {
+		return
+	}
+	wp.gate.mtx.Lock()
+	defer wp.gate.mtx.Unlock()
+	wp.gate.changed.Broadcast()
+}
+
+// awaitGate blocks until the gate is open for the work's key.  It returns early once the pool is shut down, so that the
+// submission can fail as usual
+func (wp *KeyedWorkpool[K]) awaitGate(w KeyedWork[K]) {
+	if wp.gate == nil || isNil(w) {
+		return
+	}
+	wp.gate.mtx.Lock()
+	defer wp.gate.mtx.Unlock()
+	for wp.idleCtx.Err() == nil && !wp.hooks.submitGate(w.Key()) {
+		wp.gate.changed.Wait()
+	}
+}
+
+// gateOpen returns whether the gate is open for the work's key
+func (wp *KeyedWorkpool[K]) gateOpen(w KeyedWork[K]) bool {
+	return wp.gate == nil || isNil(w) || wp.hooks.submitGate(w.Key())
+}
@@ -0,0 +1,44 @@
+package workpool
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Health summarizes whether the workpool is healthy, for a health check endpoint.  It's unhealthy while it's shutting
+// down or draining, while any key has an item which has been running for longer than the threshold given to
+// WithStallDetector, and while more items are queued than the threshold given to WithHealthQueueThreshold.  detail
+// describes every problem found, naming the stalled keys, or is "ok"
+func (wp *KeyedWorkpool[K]) Health() (ok bool, detail string) {
+	var problems []string
+	switch {
+	case atomic.LoadUint32(wp.closed) == 1:
+		problems = append(problems, "shutting down")
+	case atomic.LoadUint32(wp.draining) == 1:
+		problems = append(problems, "draining")
+	}
+	if stalled := wp.stalledKeys(); len(stalled) > 0 {
+		problems = append(problems, "stalled keys: "+strings.Join(stalled, ", "))
+	}
+	if n := atomic.LoadUint64(wp.queueLen); wp.cfg.healthQueueLen > 0 && n > wp.cfg.healthQueueLen {
+		problems = append(problems, fmt.Sprintf("%d items queued, above %d", n, wp.cfg.healthQueueLen))
+	}
+	if len(problems) == 0 {
+		return true, "ok"
+	}
+	return false, strings.Join(problems, "; ")
+}
+
+// stalledKeys returns the keys with stalled work, sorted
+func (wp *KeyedWorkpool[K]) stalledKeys() []string {
+	wp.stalledMtx.Lock()
+	defer wp.stalledMtx.Unlock()
+	keys := make([]string, 0, len(wp.stalled))
+	for key := range wp.stalled {
+		keys = append(keys, keyString(key))
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,44 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	sut := New(WithStallDetector[string](20*time.Millisecond, nil), WithHealthQueueThreshold(2))
+	ok, detail := sut.Health()
+	assert.True(t, ok)
+	assert.Equal(t, "ok", detail)
+
+	hung := make(chan struct{})
+	sut.Submit(wrk{k: "hung", d: func() { <-hung }})
+	sut.Submit(wrk{k: "fast", d: func() {}})
+	assert.Eventually(t, func() bool {
+		ok, _ := sut.Health()
+		return !ok
+	}, time.Second, time.Millisecond)
+	ok, detail = sut.Health()
+	assert.False(t, ok)
+	assert.Equal(t, "stalled keys: hung", detail)
+
+	// a growing queue behind the hung item
+	for i := 0; i < 2; i++ {
+		sut.Submit(wrk{k: "hung", d: func() {}})
+	}
+	_, detail = sut.Health()
+	assert.Equal(t, "stalled keys: hung; 3 items queued, above 2", detail)
+
+	// healthy again once the work returns
+	close(hung)
+	sut.Wait()
+	ok, _ = sut.Health()
+	assert.True(t, ok)
+
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	ok, detail = sut.Health()
+	assert.False(t, ok)
+	assert.Equal(t, "shutting down", detail)
+}
@@ -0,0 +1,63 @@
+package workpool
+
+// inFlightKey identifies running IdempotentWork, or IdempotentWork whose Result is shared (see SubmitResult)
+type inFlightKey[K comparable] struct {
+	key K
+	id  string
+}
+
+// isInFlight returns whether the work is IdempotentWork identical to work which is running
+func (wp *KeyedWorkpool[K]) isInFlight(w KeyedWork[K]) bool {
+	id, ok := idempotencyKey(w)
+	if !ok {
+		return false
+	}
+	wp.inFlightMtx.Lock()
+	defer wp.inFlightMtx.Unlock()
+	return wp.inFlight[inFlightKey[K]{key: w.Key(), id: id}] > 0
+}
+
+// trackInFlight records that the work is running, if it's IdempotentWork.  The returned function must be called once it
+// has stopped
+func (wp *KeyedWorkpool[K]) trackInFlight(w KeyedWork[K]) func() {
+	id, ok := idempotencyKey(w)
+	if !ok {
+		return func() {}
+	}
+	k := inFlightKey[K]{key: w.Key(), id: id}
+	wp.inFlightMtx.Lock()
+	wp.inFlight[k]++
+	wp.inFlightMtx.Unlock()
+	return func() {
+		wp.inFlightMtx.Lock()
+		defer wp.inFlightMtx.Unlock()
+		if wp.inFlight[k]--; wp.inFlight[k] == 0 {
+			delete(wp.inFlight, k)
+		}
+	}
+}
+
+// coalesce returns the Result of IdempotentWork identical to the work which was submitted by SubmitResult and hasn't
+// completed, and true.  Otherwise r becomes the Result to share until it completes, and false is returned.  The work
+// must be admitted, so that r is sure to complete
+func (wp *KeyedWorkpool[K]) coalesce(w KeyedWork[K], r *Result) (*Result, bool) {
+	id, ok := idempotencyKey(w)
+	if !ok {
+		return nil, false
+	}
+	k := inFlightKey[K]{key: w.Key(), id: id}
+	wp.inFlightMtx.Lock()
+	defer wp.inFlightMtx.Unlock()
+	if shared, ok := wp.coalescing[k]; ok {
+		return shared, true
+	}
+	wp.coalescing[k] = r
+	r.onComplete = func() {
+		wp.inFlightMtx.Lock()
+		defer wp.inFlightMtx.Unlock()
+		if wp.coalescing[k] == r {
+			delete(wp.coalescing, k)
+		}
+	}
+	return nil, false
+}
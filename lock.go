@@ -0,0 +1,69 @@
+package workpool
+
+import "context"
+
+// KeyedLockProvider serializes each key's work across processes, for pools sharing keys over a cluster (see
+// WithLockProvider).  Acquire blocks until the key's lock is held, or returns an error if it can't be taken, including
+// once ctx is done.  Release gives up the lock taken by the last successful Acquire for the key.  A workpool only holds
+// one lock per key at a time, but calls for different keys may be concurrent
+type KeyedLockProvider[K comparable] interface {
+	Acquire(ctx context.Context, key K) error
+	Release(key K)
+}
+
+// LockProvider is a KeyedLockProvider for string keys
+type LockProvider = KeyedLockProvider[string]
+
+// acquireLock takes the key's lock from the lock provider, if there is one, for an item about to run.  Unordered keys
+// promise no ordering to serialize, so they're never locked.  An error is reported on the Errors channel, unless it's
+// because the pool was closed while waiting
+func (wp *KeyedWorkpool[K]) acquireLock(key K) error {
+	if !wp.locked(key) {
+		return nil
+	}
+	if err := wp.hooks.lockProvider.Acquire(wp.ctx, key); err != nil {
+		if wp.ctx.Err() != nil {
+			return ErrWorkDropped
+		}
+		wp.debug("workpool: failed to acquire the key's lock", key)
+		wp.report(key, err)
+		return err
+	}
+	return nil
+}
+
+func (wp *KeyedWorkpool[K]) releaseLock(key K) {
+	if wp.locked(key) {
+		wp.hooks.lockProvider.Release(key)
+	}
+}
+
+// lockKeys takes the locks of all the given keys from the lock provider, in order, for a MultiKeyWork.  If any can't be
+// taken, those already taken are released, and the error is returned to be handled like the work's own
+func (wp *KeyedWorkpool[K]) lockKeys(keys []K) error {
+	for i, key := range keys {
+		if !wp.locked(key) {
+			continue
+		}
+		if err := wp.hooks.lockProvider.Acquire(wp.ctx, key); err != nil {
+			wp.unlockKeys(keys[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func (wp *KeyedWorkpool[K]) unlockKeys(keys []K) {
+	for _, key := range keys {
+		wp.releaseLock(key)
+	}
+}
+
+// locked returns whether the key's work runs under the lock provider
+func (wp *KeyedWorkpool[K]) locked(key K) bool {
+	if wp.hooks.lockProvider == nil {
+		return false
+	}
+	_, unordered := wp.parallelism(key)
+	return !unordered
+}
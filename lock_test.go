@@ -0,0 +1,77 @@
+package workpool
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memLocks is an in-memory LockProvider, standing in for a distributed one
+type memLocks struct {
+	mtx   sync.Mutex
+	locks map[string]chan struct{}
+	// returned by Acquire instead of locking, if set
+	err error
+}
+
+func (m *memLocks) lock(key string) chan struct{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.locks == nil {
+		m.locks = map[string]chan struct{}{}
+	}
+	if _, ok := m.locks[key]; !ok {
+		m.locks[key] = make(chan struct{}, 1)
+	}
+	return m.locks[key]
+}
+
+func (m *memLocks) Acquire(ctx context.Context, key string) error {
+	if m.err != nil {
+		return m.err
+	}
+	select {
+	case m.lock(key) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *memLocks) Release(key string) {
+	<-m.lock(key)
+}
+
+func TestLockProvider(t *testing.T) {
+	locks := &memLocks{}
+	// two pools sharing a key, as if in different processes
+	pools := []*Workpool{New(WithLockProvider(locks)), New(WithLockProvider(locks))}
+	var running, overlaps int32
+	for i := 0; i < 20; i++ {
+		for _, sut := range pools {
+			sut.Submit(wrk{k: "key", d: func() {
+				if atomic.AddInt32(&running, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(100 * time.Microsecond)
+				atomic.AddInt32(&running, -1)
+			}})
+		}
+	}
+	for _, sut := range pools {
+		sut.Wait()
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&overlaps))
+	assert.Empty(t, locks.lock("key"), "every lock was released")
+
+	boom := errors.New("boom")
+	sut := New(WithLockProvider(&memLocks{err: boom}))
+	res := sut.SubmitResult(wrk{k: "key", d: func() { t.Error("ran without the lock") }})
+	res.Wait()
+	assert.ErrorIs(t, res.Err(), boom)
+	assert.Equal(t, KeyError{Key: "key", Err: boom}, <-sut.Errors())
+}
@@ -0,0 +1,84 @@
+package workpool
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// errEvicted is returned by awaitWork when the key is evicted while it waits
+var errEvicted = errors.New("workpool: idle key evicted")
+
+// idleKeys orders the keys whose managers are waiting for work, least recently used first, so that the oldest can be
+// evicted once too many keys are tracked (see WithMaxTrackedKeys)
+type idleKeys[K comparable] struct {
+	mtx sync.Mutex
+	// each value is an idleKey.  The front is the key which has been idle for longest
+	order *list.List
+	elems map[K]*list.Element
+	// keys which have been evicted, but whose managers haven't yet retired them.  They're still tracked
+	evicting int64
+}
+
+// idleKey is an idle key, and how to wake its manager so that it retires
+type idleKey[K comparable] struct {
+	key   K
+	evict context.CancelFunc
+}
+
+func newIdleKeys[K comparable]() *idleKeys[K] {
+	return &idleKeys[K]{order: list.New(), elems: map[K]*list.Element{}}
+}
+
+// markIdle records that the key's manager has started waiting for work, which the given function interrupts.  The
+// returned function must be called once the manager stops waiting, and returns whether the key was evicted in the
+// meantime.  If too many keys are tracked, the least recently used idle keys are evicted
+func (wp *KeyedWorkpool[K]) markIdle(key K, evict context.CancelFunc) func() bool {
+	if wp.idle == nil {
+		return func() bool { return false }
+	}
+	wp.idle.mtx.Lock()
+	wp.idle.elems[key] = wp.idle.order.PushBack(idleKey[K]{key: key, evict: evict})
+	wp.idle.mtx.Unlock()
+	wp.evictIdle()
+	return func() bool {
+		wp.idle.mtx.Lock()
+		defer wp.idle.mtx.Unlock()
+		el, ok := wp.idle.elems[key]
+		if ok {
+			wp.idle.order.Remove(el)
+			delete(wp.idle.elems, key)
+		}
+		return !ok
+	}
+}
+
+// evictIdle wakes the managers of the least recently used idle keys, until no more than the maximum number of keys are
+// tracked.  Each evicted manager retires its key as if it had timed out.  Keys with work are never evicted, so more keys
+// than the maximum stay tracked while they're all busy
+func (wp *KeyedWorkpool[K]) evictIdle() {
+	if wp.idle == nil {
+		return
+	}
+	wp.idle.mtx.Lock()
+	defer wp.idle.mtx.Unlock()
+	// evicted keys are still tracked until their managers get round to retiring them, so they don't count
+	excess := atomic.LoadInt64(wp.tracked) - wp.idle.evicting - int64(wp.cfg.maxTrackedKeys)
+	for ; excess > 0 && wp.idle.order.Len() > 0; excess-- {
+		ik := wp.idle.order.Remove(wp.idle.order.Front()).(idleKey[K])
+		delete(wp.idle.elems, ik.key)
+		wp.idle.evicting++
+		wp.debug("workpool: evicting least recently used idle key", ik.key)
+		ik.evict()
+	}
+}
+
+// evicted is called by an evicted manager once it has tried to retire its key, or once it has found work instead.  A key
+// which isn't retired stays tracked, and may be evicted again once it's idle
+func (wp *KeyedWorkpool[K]) evicted() {
+	wp.idle.mtx.Lock()
+	defer wp.idle.mtx.Unlock()
+	wp.idle.evicting--
+}
@@ -0,0 +1,189 @@
+package workpool
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyedMultiKeyWork is work which must be serialized against several keys at once, such as a transaction across
+// entities.  It's queued for each of its keys, behind the work already submitted for them, and only runs once it's at
+// the head of every one of their queues, holding all of them until it has finished.  Later work for any of its keys
+// waits for it.  It runs on its own key, where it takes its slot under WithMaxConcurrency once its keys are held, and
+// then the locks of all its keys from any lock provider (see WithLockProvider), in sorted order.
+// A MultiKeyWork's place in each of its keys' queues follows the order everything was submitted in, which is what keeps
+// keys holding each other from deadlocking.  So its keys must have the built-in queue, or a Queue from WithQueueFactory
+// which is FIFO, and it ignores PriorityWork and the like, and is queued behind newer work on a LIFO key (see
+// WithKeyOrdering).  It counts once towards WithMaxTotalQueue, but while it's waiting for its keys, it counts as an item
+// of each of them everywhere else, such as in QueueLen, Stats, events and completion callbacks.  Purging one of its
+// other keys (see PurgeKey) lets it run without holding that key.  An unordered key (see WithUnorderedKey) may run other
+// work alongside it.  Under WithExecutor, it's handed to the executor as soon as it reaches the head of its own key's
+// queue, and takes one of its workers while waiting for its other keys, so an executor with a fixed number of workers
+// must have more of them than there can be MultiKeyWork waiting at once.  With WithShards or WithSynchronous, it's run
+// as ordinary work for its own key: the former can't hold several keys of a shard at once, and the latter runs all work
+// one item at a time anyway
+type KeyedMultiKeyWork[K comparable] interface {
+	KeyedWork[K]
+
+	// Keys returns the keys the work must be serialized against.  Its own Key is included whether it's listed or not
+	Keys() []K
+}
+
+// MultiKeyWork is a KeyedMultiKeyWork for string keys
+type MultiKeyWork = KeyedMultiKeyWork[string]
+
+// barrier gathers the keys of a MultiKeyWork
+type barrier struct {
+	// how many of the work's other keys have yet to reach it
+	waiting int32
+	// closed once every other key has reached the work
+	arrived chan struct{}
+	// closed once the work has finished or been dropped, letting its other keys move on
+	done chan struct{}
+	once sync.Once
+}
+
+func newBarrier(others int) *barrier {
+	b := &barrier{waiting: int32(others), arrived: make(chan struct{}), done: make(chan struct{})}
+	if others == 0 {
+		close(b.arrived)
+	}
+	return b
+}
+
+// arrive records that one of the work's other keys has reached it
+func (b *barrier) arrive() {
+	if atomic.AddInt32(&b.waiting, -1) == 0 {
+		close(b.arrived)
+	}
+}
+
+// finish lets the work's other keys move on
+func (b *barrier) finish() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// multiWork is a MultiKeyWork in the queue of its own key, where it runs
+type multiWork[K comparable] struct {
+	work    KeyedMultiKeyWork[K]
+	barrier *barrier
+	// all the work's keys, in the order their locks are taken
+	keys []K
+}
+
+func (mw multiWork[K]) Key() K {
+	return mw.work.Key()
+}
+
+// Do is never called: the work is run by doMulti
+func (mw multiWork[K]) Do() {}
+
+// Size is the size of the work, which was counted against WithMaxQueueBytes before it was wrapped
+func (mw multiWork[K]) Size() int64 {
+	return size(mw.work)
+}
+
+// holdWork holds one of a MultiKeyWork's other keys, from when it reaches the work until the work has finished
+type holdWork[K comparable] struct {
+	key     K
+	work    KeyedMultiKeyWork[K]
+	barrier *barrier
+	// each hold arrives once, whether it's reached or dropped
+	arrived *sync.Once
+}
+
+func (hw holdWork[K]) Key() K {
+	return hw.key
+}
+
+// Do is never called: the key is held by hold
+func (hw holdWork[K]) Do() {}
+
+func (hw holdWork[K]) arrive() {
+	hw.arrived.Do(hw.barrier.arrive)
+}
+
+// enqueueMultiLocked queues the work for its own key, and a hold for each of its other keys.  Everything is queued under
+// the submit mutex, so every pair of MultiKeyWorks is in the same order in each of the keys they share.  The submit
+// mutex must be held
+func (wp *KeyedWorkpool[K]) enqueueMultiLocked(e entry[K], w KeyedMultiKeyWork[K]) {
+	keys := []K{w.Key()}
+	for _, key := range w.Keys() {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(keyString(a), keyString(b))
+	})
+	b := newBarrier(len(keys) - 1)
+	e.work = multiWork[K]{work: w, barrier: b, keys: keys}
+	wp.enqueueLocked(e)
+	for _, key := range keys {
+		if key != w.Key() {
+			wp.enqueueLocked(entry[K]{work: holdWork[K]{key: key, work: w, barrier: b, arrived: &sync.Once{}}})
+		}
+	}
+}
+
+// doMulti runs a MultiKeyWork once all its keys have reached it, taking its slot and its keys' locks as it does
+func (wp *KeyedWorkpool[K]) doMulti(key K, mw multiWork[K]) error {
+	select {
+	case <-mw.barrier.arrived:
+	case <-wp.ctx.Done():
+		return ErrWorkDropped
+	}
+	if !wp.acquireSlot(mw.work) {
+		return ErrWorkDropped
+	}
+	defer wp.releaseSlot(mw.work)
+	if err := wp.lockKeys(mw.keys); err != nil {
+		return err
+	}
+	defer wp.unlockKeys(mw.keys)
+	return wp.do(key, mw.work)
+}
+
+// hold keeps the key held by a MultiKeyWork until the work has finished
+func (wp *KeyedWorkpool[K]) hold(hw holdWork[K]) {
+	hw.arrive()
+	select {
+	case <-hw.barrier.done:
+	case <-wp.ctx.Done():
+	}
+}
+
+// isPart returns whether the work is part of a MultiKeyWork, which takes its slot and locks itself (see doMulti)
+func isPart[K comparable](w KeyedWork[K]) bool {
+	switch w.(type) {
+	case multiWork[K], holdWork[K]:
+		return true
+	}
+	return false
+}
+
+// finishPart lets a MultiKeyWork's keys move on once the work has finished or been dropped, and lets the work run once
+// its hold of a key is reached or dropped.  It returns whether the work counted against WithMaxTotalQueue: a hold
+// doesn't, since the work is counted once
+func finishPart[K comparable](w KeyedWork[K]) bool {
+	switch w := w.(type) {
+	case multiWork[K]:
+		w.barrier.finish()
+	case holdWork[K]:
+		w.arrive()
+		return false
+	}
+	return true
+}
+
+// unwrapPart returns the MultiKeyWork which the given work is part of, or the work itself
+func unwrapPart[K comparable](w KeyedWork[K]) KeyedWork[K] {
+	switch w := w.(type) {
+	case multiWork[K]:
+		return w.work
+	case holdWork[K]:
+		return w.work
+	}
+	return w
+}
@@ -0,0 +1,145 @@
+package workpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type multiWrk struct {
+	k    string
+	keys []string
+	d    func()
+}
+
+func (m multiWrk) Key() string {
+	return m.k
+}
+
+func (m multiWrk) Keys() []string {
+	return m.keys
+}
+
+func (m multiWrk) Do() {
+	m.d()
+}
+
+// exclusive records what runs for each key, failing if anything runs for a key while something else is
+type exclusive struct {
+	t       *testing.T
+	mtx     sync.Mutex
+	running map[string]bool
+	ran     map[string][]string
+}
+
+func (x *exclusive) work(name string, keys ...string) func() {
+	return func() {
+		x.mtx.Lock()
+		for _, key := range keys {
+			assert.False(x.t, x.running[key], "%s ran alongside other work for %s", name, key)
+			x.running[key] = true
+			x.ran[key] = append(x.ran[key], name)
+		}
+		x.mtx.Unlock()
+		time.Sleep(time.Millisecond)
+		x.mtx.Lock()
+		defer x.mtx.Unlock()
+		for _, key := range keys {
+			x.running[key] = false
+		}
+	}
+}
+
+func TestMultiKeyWork(t *testing.T) {
+	x := &exclusive{t: t, running: map[string]bool{}, ran: map[string][]string{}}
+	sut := New()
+	sut.PauseAll()
+	sut.Submit(wrk{k: "b", d: x.work("b1", "b")})
+	sut.Submit(multiWrk{k: "a", keys: []string{"a", "b"}, d: x.work("ab", "a", "b")})
+	sut.Submit(multiWrk{k: "c", keys: []string{"b"}, d: x.work("bc", "b", "c")})
+	sut.Submit(wrk{k: "a", d: x.work("a1", "a")})
+	sut.Submit(wrk{k: "b", d: x.work("b2", "b")})
+	sut.Submit(wrk{k: "c", d: x.work("c1", "c")})
+	// a MultiKeyWork counts once towards the queue's limits, but once for each key it's waiting for
+	assert.Equal(t, uint64(8), sut.QueueLen())
+	// and is shown in each of their queues
+	held, ok := sut.SnapshotWork()["b"][1].(MultiKeyWork)
+	assert.True(t, ok)
+	assert.Equal(t, "a", held.Key())
+	sut.ResumeAll()
+	sut.Wait()
+
+	// each key's work ran in the order it was submitted, including the work serialized against it
+	assert.Equal(t, map[string][]string{
+		"a": {"ab", "a1"},
+		"b": {"b1", "ab", "bc", "b2"},
+		"c": {"bc", "c1"},
+	}, x.ran)
+
+	// a MultiKeyWork can't be replaced, neither on its own key nor on the others it's holding
+	sut.Pause("a")
+	sut.Pause("b")
+	sut.Submit(multiWrk{k: "a", keys: []string{"b"}, d: x.work("ab2", "a", "b")})
+	assert.False(t, sut.ReplaceHead("a", wrk{k: "a", d: func() {}}))
+	assert.False(t, sut.ReplaceHead("b", wrk{k: "b", d: func() {}}))
+	sut.Resume("a")
+	sut.Resume("b")
+	sut.Wait()
+	assert.Equal(t, []string{"b1", "ab", "bc", "b2", "ab2"}, x.ran["b"])
+}
+
+func TestMultiKeyWorkExecutor(t *testing.T) {
+	// a single worker, which the work takes while its hold of its other key must still run
+	worker := make(chan func())
+	defer close(worker)
+	go func() {
+		for run := range worker {
+			run()
+		}
+	}()
+	sut := New(WithExecutor(func(run func()) { worker <- run }))
+	ran := make(chan struct{})
+	sut.Submit(multiWrk{k: "a", keys: []string{"b"}, d: func() { close(ran) }})
+	select {
+	case <-ran:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	sut.Wait()
+}
+
+func TestMultiKeyWorkDoesNotDeadlock(t *testing.T) {
+	locks := &memLocks{}
+	x := &exclusive{t: t, running: map[string]bool{}, ran: map[string][]string{}}
+	// two workpools standing in for two processes, sharing locks
+	pools := []*Workpool{
+		New(WithMaxConcurrency(1), WithLockProvider(locks)),
+		New(WithMaxConcurrency(2), WithLockProvider(locks)),
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for i := 0; i < 100; i++ {
+		// overlapping sets of keys, run on each of their keys in turn
+		k1, k2 := keys[i%len(keys)], keys[(i+1+i/len(keys)%(len(keys)-1))%len(keys)]
+		pools[i%2].Submit(multiWrk{k: k2, keys: []string{k1}, d: x.work(strconv.Itoa(i), k1, k2)})
+		pools[i%2].Submit(wrk{k: k1, d: x.work(strconv.Itoa(i)+"-single", k1)})
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, sut := range pools {
+			sut.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	total := 0
+	for _, ran := range x.ran {
+		total += len(ran)
+	}
+	assert.Equal(t, 100*3, total)
+}
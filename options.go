@@ -0,0 +1,678 @@
+package workpool
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"log"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Option configures a Workpool.  Options are passed to New
+type Option func(*config)
+
+// config holds everything that can be tuned about a Workpool.  Functions of keys are held as interface{}, since options
+// aren't specific to a type of key, and are checked against the pool's type of key by newHooks
+type config struct {
+	// called with the offending work, the recovered value and the stack whenever a Work's Do panics.  nil for logPanic
+	panicHandler interface{}
+	// size of the Errors channel's buffer
+	errBuffer int
+	// whether lifecycle events are delivered on the Events channel
+	events bool
+	// how long a key's management goroutine waits for more work before dying
+	idleTimeout time.Duration
+	// how far back the throughput gauges look
+	meterWindow time.Duration
+	// whether each key's throughput is tracked as well as the workpool's
+	keyThroughput bool
+	// the fraction of idleTimeout which may be randomly added to it.  0 is no jitter
+	idleJitter float64
+	// how many items may run at once across all keys.  0 is unlimited
+	maxConcurrency int
+	// whether work submitted for a key which already has work is dropped
+	dropWhileBusy bool
+	// how many items TrySubmit allows to be queued per key.  0 is unlimited
+	maxQueueDepth int
+	// how many times an ErrWork is attempted before its error is reported
+	retryAttempts int
+	// how long to wait before retrying an ErrWork, given how many times it has failed
+	retryBackoff func(attempt int) time.Duration
+	// the rate at which each key may start work.  nil if no key is limited
+	keyRateLimit interface{}
+	// called after each item is run.  nil if unset
+	onComplete interface{}
+	// called after each item is run, with its time queued and time in Do.  nil if unset
+	onCompleteTimings interface{}
+	// called when a key's manager exits idle.  nil if unset
+	onKeyIdle interface{}
+	// creates a span for each item.  nil if tracing is disabled
+	tracer trace.Tracer
+	// receives debug logs about each key's lifecycle
+	logger *slog.Logger
+	// whether consecutive DedupeWork is collapsed
+	dedupe bool
+	// how long SequencedWork waits for work with lower sequence numbers.  0 doesn't reorder
+	reorderWindow time.Duration
+	// how long each item may run before it is cancelled or reported.  0 is unlimited
+	workTimeout time.Duration
+	// whether concurrency slots are handed out round-robin across keys
+	fairDispatch bool
+	// how many lanes LanedWork waits for concurrency slots in.  1 or less is a single lane
+	priorityLanes int
+	// whether the concurrency slots are shared fairly between TenantWork's tenants
+	tenantFairness bool
+	// whether submitters run work themselves, rather than managers
+	synchronous bool
+	// how many goroutines keys are hashed onto.  0 for a manager per key
+	shards int
+	// runs each item.  nil to run items on the workpool's own goroutines
+	executor func(func())
+	// whether each manager locks itself to an OS thread and runs its key's work there
+	threadAffinity bool
+	// whether work for a key may be submitted.  nil if submissions aren't gated
+	submitGate interface{}
+	// the queue depth above which highWatermarkCb is called
+	highWatermark int
+	// called when a key's queue crosses highWatermark, and when it recovers.  nil if unset
+	highWatermarkCb interface{}
+	// how long a key may wait for a concurrency slot before onStarvation is called
+	starvationThreshold time.Duration
+	// called when a key has waited too long for a concurrency slot.  nil if unset
+	onStarvation interface{}
+	// how long an item may run before onStall is called
+	stallThreshold time.Duration
+	// called when an item has run for too long.  nil if unset
+	onStall interface{}
+	// the queue length above which Health reports the workpool unhealthy.  0 is unlimited
+	healthQueueLen uint64
+	// called with the record of each item once it has run.  nil if unset
+	auditSink interface{}
+	// chooses the order each key's work runs in.  nil for FIFO
+	keyOrdering interface{}
+	// how long work may wait in its queue before it's dropped.  0 is unlimited
+	queueTTL time.Duration
+	// creates each key's queue.  nil for the built-in queue
+	queueFactory interface{}
+	// how many items may be submitted but not yet finished, across all keys.  0 is unlimited
+	maxTotalQueue int
+	// how many bytes of SizedWork may be submitted but not yet finished, across all keys.  0 is unlimited
+	maxQueueBytes int64
+	// how many keys may be tracked before idle keys are evicted.  0 is unlimited
+	maxTrackedKeys int
+	// how many items may run at once for each unordered key.  Keys which aren't present are ordered
+	unordered map[interface{}]int
+	// how many items may run at once for every key not in unordered.  1 or less is strictly ordered
+	perKeyConcurrency int
+	// how many consecutive failures open a key's circuit breaker.  0 disables the breaker
+	breakerThreshold int
+	// how long an open circuit breaker fails work fast before letting an item through
+	breakerCooldown time.Duration
+	// serializes each key's work across processes.  nil if keys are only serialized in-process
+	lockProvider interface{}
+}
+
+// hooks holds the config's functions of keys, for a pool's type of key
+type hooks[K comparable] struct {
+	panicHandler      func(w KeyedWork[K], recovered interface{}, stack []byte)
+	keyRateLimit      func(key K) rate.Limit
+	onComplete        func(key K, duration time.Duration)
+	onCompleteTimings func(key K, queueWait, execTime time.Duration)
+	onKeyIdle         func(key K)
+	queueFactory      func(key K) KeyedQueue[K]
+	lockProvider      KeyedLockProvider[K]
+	submitGate        func(key K) bool
+	highWatermark     func(key K, depth int)
+	onStarvation      func(key K, waited time.Duration)
+	onStall           func(key K, age time.Duration)
+	auditSink         func(KeyedAuditRecord[K])
+	keyOrdering       func(key K) Ordering
+	unordered         map[K]int
+}
+
+// newHooks takes the functions of keys from the config.  It panics if any was given for another type of key
+func newHooks[K comparable](cfg config) hooks[K] {
+	h := hooks[K]{panicHandler: logPanic[K]}
+	keyed(cfg.panicHandler, &h.panicHandler)
+	keyed(cfg.keyRateLimit, &h.keyRateLimit)
+	keyed(cfg.onComplete, &h.onComplete)
+	keyed(cfg.onCompleteTimings, &h.onCompleteTimings)
+	keyed(cfg.onKeyIdle, &h.onKeyIdle)
+	keyed(cfg.queueFactory, &h.queueFactory)
+	keyed(cfg.lockProvider, &h.lockProvider)
+	keyed(cfg.submitGate, &h.submitGate)
+	keyed(cfg.highWatermarkCb, &h.highWatermark)
+	keyed(cfg.onStarvation, &h.onStarvation)
+	keyed(cfg.onStall, &h.onStall)
+	keyed(cfg.auditSink, &h.auditSink)
+	keyed(cfg.keyOrdering, &h.keyOrdering)
+	if len(cfg.unordered) > 0 {
+		h.unordered = map[K]int{}
+		for key, parallelism := range cfg.unordered {
+			var k K
+			keyed(key, &k)
+			h.unordered[k] = parallelism
+		}
+	}
+	return h
+}
+
+// keyed sets dst to v, unless v is unset
+func keyed[T any](v interface{}, dst *T) {
+	if v == nil {
+		return
+	}
+	t, ok := v.(T)
+	if !ok {
+		panic(fmt.Sprintf("workpool: option given %T, which doesn't match the pool's type of key", v))
+	}
+	*dst = t
+}
+
+func defaultConfig() config {
+	return config{
+		errBuffer:     100,
+		idleTimeout:   100 * time.Millisecond,
+		meterWindow:   defaultThroughputWindow,
+		retryAttempts: 1,
+		retryBackoff:  noBackoff,
+		logger:        slog.New(discardHandler{}),
+	}
+}
+
+// WithPanicHandler sets the function called when a Work's Do panics, with the offending work, the recovered value, and
+// the stack of the goroutine which panicked, as from debug.Stack.  The panic is recovered so that the rest of the work
+// for that key can continue; the handler decides what else to do with it, such as submitting the work again.  The
+// handler is called after the key has been released, so it may safely re-panic.  The default handler logs the panic and
+// its stack via the standard library logger, and drops the work.
+func WithPanicHandler[K comparable](h func(w KeyedWork[K], recovered interface{}, stack []byte)) Option {
+	return func(c *config) {
+		c.panicHandler = h
+	}
+}
+
+func logPanic[K comparable](w KeyedWork[K], recovered interface{}, stack []byte) {
+	log.Printf("workpool: recovered panic in work for key %q: %v\n%s", keyString(w.Key()), recovered, stack)
+}
+
+// WithErrorBuffer sets the size of the buffer behind the Errors channel.  Once the buffer is full, further errors are
+// dropped until it is read from.  The default is 100
+func WithErrorBuffer(n int) Option {
+	return func(c *config) {
+		c.errBuffer = n
+	}
+}
+
+// WithEvents enables the Events channel, which streams what the workpool does with each key: when it's seen, when its
+// manager starts and stops, and when each of its items starts and completes.  It's meant for debugging and dashboards,
+// so events are dropped rather than holding up work when nobody keeps up with them
+func WithEvents() Option {
+	return func(c *config) {
+		c.events = true
+	}
+}
+
+// WithIdleTimeout sets how long a key's management goroutine lingers once the key has no more work.  A longer timeout
+// avoids the cost of respawning the goroutine (and the key's state) for keys which see regular work, at the cost of
+// holding on to them for longer.  A shorter timeout frees idle keys sooner.  The default is 100ms
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.idleTimeout = d
+	}
+}
+
+// WithThroughputWindow sets how far back the throughput gauges (see Stats and KeyThroughput) look: each is a moving
+// average of the rate at which items finish, in which an item's weight decays exponentially over the window.  A short
+// window tracks changes in load quickly, and a long one smooths out bursts.  The default is 10 seconds
+func WithThroughputWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.meterWindow = d
+	}
+}
+
+// WithKeyThroughput tracks the throughput of each key as well as of the whole workpool, for KeyThroughput.  It's off by
+// default, since it costs a little memory per key
+func WithKeyThroughput() Option {
+	return func(c *config) {
+		c.keyThroughput = true
+	}
+}
+
+// WithDropWhileBusy sheds load by dropping work submitted for a key which is busy, rather than queueing it, so that each
+// key only takes on work as fast as it can process it, as for sampling.  A key is busy from when an item is submitted
+// until it has finished, so each key has at most one item at a time.  Dropped work never runs: a Result completes with
+// ErrWorkDropped, an ItemDropped event is emitted, and it's counted in Stats.  MultiKeyWork and Flush's marker are
+// never dropped, and a batch's items for a key are all dropped or all queued (see SubmitBatch)
+func WithDropWhileBusy() Option {
+	return func(c *config) {
+		c.dropWhileBusy = true
+	}
+}
+
+// WithIdleJitter randomly lengthens each idle timeout (see WithIdleTimeout) by up to the given fraction of it.  Keys
+// which see a burst of work together otherwise go idle together, and with many keys that means a burst of goroutines
+// waking and exiting at once.  For example, 0.5 spreads a 100ms idle timeout over 100-150ms.  By default there is no
+// jitter, so that idle timeouts are predictable.  WithIdleJitter panics if the fraction is negative or NaN.
+// There's no backoff for keys which stay idle: an idle manager doesn't poll, but sleeps until its key has work, and
+// exits after a single timeout, so a cold key costs no wake-ups beyond that one
+func WithIdleJitter(fraction float64) Option {
+	if fraction < 0 || math.IsNaN(fraction) {
+		panic(fmt.Sprintf("workpool: idle jitter of %v isn't a fraction", fraction))
+	}
+	return func(c *config) {
+		c.idleJitter = fraction
+	}
+}
+
+// WithMaxConcurrency limits how many items may run at once across all keys.  Once the limit is reached, each key's
+// next item waits for a running item to finish.  Per-key ordering is unaffected.  By default there is no limit: every
+// key with work may have an item running
+func WithMaxConcurrency(n int) Option {
+	return func(c *config) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithFairDispatch hands out the slots allowed by WithMaxConcurrency round-robin across keys with pending work, so that
+// a key with a single item gets a turn before a busy key gets another.  Unlike the default, an item too heavy (see
+// WeightedWork) for the free slots doesn't hold up lighter items from other keys while it waits, which means that heavy
+// items may wait longer under sustained load.  It has no effect without WithMaxConcurrency
+func WithFairDispatch() Option {
+	return func(c *config) {
+		c.fairDispatch = true
+	}
+}
+
+// WithPriorityLanes ranks work across keys into n lanes, for tiers of work such as "interactive" and "batch": whenever a
+// slot allowed by WithMaxConcurrency frees up, the work waiting in the highest lane gets it, with lane 0 last (see
+// LanedWork).  Within a lane, slots are handed out as by WithFairDispatch, which lanes imply.  Lanes only rank the work
+// at the head of each key's queue, so a key's work still runs in order: an item in a high lane queued behind one in a
+// low lane waits for it.  Low lanes may starve under sustained high lane load.  It has no effect without
+// WithMaxConcurrency
+func WithPriorityLanes(n int) Option {
+	return func(c *config) {
+		c.priorityLanes = n
+	}
+}
+
+// WithTenantFairness shares the slots allowed by WithMaxConcurrency fairly between tenants (see TenantWork), so that a
+// tenant flooding many keys with work can't starve another: whenever a slot frees up, it goes to the waiting tenant
+// which holds the fewest slots.  Each tenant's keys take turns as by WithFairDispatch, which tenant fairness implies,
+// and each key's work still runs in order.  Priority lanes (see WithPriorityLanes) rank work before tenants do.  It has
+// no effect without WithMaxConcurrency
+func WithTenantFairness() Option {
+	return func(c *config) {
+		c.tenantFairness = true
+	}
+}
+
+// WithSynchronous is for tests: it makes the workpool run work on the goroutine which submits it, before Submit (or any
+// other way of submitting) returns, rather than on a manager goroutine per key.  Work runs in the order it was
+// submitted, across all keys, one item at a time, which takes timing out of tests of the code which uses the workpool.
+// This changes the workpool's concurrency completely, so don't use it in production.  Work submitted by running work,
+// or while another goroutine's submission is running work, is run by that goroutine once it's through what came before,
+// so it runs after Submit returns.  DelayedWork and retries (see WithRetry) are waited for by sleeping.  Pauses, rate
+// limits and idle timeouts have no effect, and keys are never retired, so WithOnKeyIdle isn't called
+func WithSynchronous() Option {
+	return func(c *config) {
+		c.synchronous = true
+	}
+}
+
+// WithShards caps the workpool's goroutines for very many keys: rather than a management goroutine per key, keys are
+// hashed onto n shards, each of which runs the work of its keys on a single goroutine.  A key's work still runs in
+// order, but keys which share a shard take turns an item at a time, so they run one after another rather than
+// alongside each other, and whatever holds up a key, such as a pause, WithKeyRateLimit, a retry's backoff or
+// DelayedWork, holds up its whole shard.  Unordered keys (see WithUnorderedKey) run one item at a time too.  A shard's
+// goroutine exits as soon as its keys have no work, and each key is retired as soon as its queue empties, regardless of
+// the idle timeout.  NumManagers and Stats count the keys with work rather than goroutines
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithExecutor hands each item to the given executor to run, such as a caller's own goroutine pool, rather than running
+// it on the workpool's goroutines.  The workpool still decides when each item may run, so ordering within a key is
+// unaffected.  The executor is called by the key's manager, so it may block, holding up only that key until it accepts
+// the item.  The executor must run every func it's given, eventually: the key is held until its item has run, so an item
+// which is never run stalls its key, and Shutdown and Wait never return.  MultiKeyWork takes a worker while it waits for
+// its keys (see KeyedMultiKeyWork)
+func WithExecutor(executor func(run func())) Option {
+	return func(c *config) {
+		c.executor = executor
+	}
+}
+
+// WithThreadAffinity pins each key's work to an OS thread, for work which relies on thread-local state, such as some
+// cgo libraries.  Each key's manager locks its goroutine to its OS thread (see runtime.LockOSThread) and runs the key's
+// work itself, rather than on a goroutine per item, so that all of it runs on the same thread.  That has costs:
+//   - the affinity only lasts as long as the manager: once the key goes idle (see WithIdleTimeout) its manager exits,
+//     and the key's next work may run on a different thread.  A longer idle timeout keeps a key's thread for longer.
+//     The thread of an exiting manager is never reused, so that its state can't leak into other goroutines
+//   - every active key holds an OS thread of its own, so very many keys mean very many threads
+//   - an unordered key's work (see WithUnorderedKey) runs one item at a time, and WithExecutor is ignored
+//   - completion callbacks (see WithOnComplete) are made on the manager's thread, so they hold up the key's next item
+//
+// With WithShards, each shard's goroutine is locked to its thread instead, so a key keeps its thread for as long as its
+// shard has work.  It has no effect with WithSynchronous
+func WithThreadAffinity() Option {
+	return func(c *config) {
+		c.threadAffinity = true
+	}
+}
+
+// WithSubmitGate applies admission control to submissions, for example to hold work back while disk space is low or a
+// downstream is unhealthy.  The gate is asked about each item's key as it's submitted.  While the gate returns false,
+// Submit and the other blocking ways of submitting work wait, and TrySubmit returns false.  The gate isn't polled: after
+// anything which may open it, call NotifyGateChanged so that waiting submissions ask again.  Shutdown and Close release
+// waiting submissions, which then panic with ErrPoolClosed.  The gate is called under a lock shared by every waiting
+// submission, so it should be quick
+func WithSubmitGate[K comparable](gate func(key K) bool) Option {
+	return func(c *config) {
+		c.submitGate = gate
+	}
+}
+
+// WithQueueHighWatermark warns of a key's queue growing long, before it's a problem: the callback is called with the
+// key and its queue's depth once the queue grows past n items, and called again once it has recovered to n/2 or fewer.
+// Work is still accepted above the watermark (see WithMaxQueueDepth for a hard limit).  The gap between the two depths
+// means a queue hovering around n calls back once, not on every item, and the depth tells a crossing (above n) from a
+// recovery (n/2 or fewer).  A crossing is called back by the submitter, and a recovery by the key's manager, holding up
+// the key until the callback returns
+func WithQueueHighWatermark[K comparable](n int, cb func(key K, depth int)) Option {
+	return func(c *config) {
+		c.highWatermark = n
+		c.highWatermarkCb = cb
+	}
+}
+
+// WithOnStarvation sets a function which is called when a key with work ready to run has waited longer than threshold
+// for a slot under WithMaxConcurrency, as when a few busy keys monopolize a small limit.  It's called once per item,
+// from a goroutine of its own, while the item is still waiting, with how long it has waited so far.  Work waiting on
+// anything else, such as a paused key or WithKeyRateLimit, isn't starved.  It has no effect without WithMaxConcurrency
+func WithOnStarvation[K comparable](threshold time.Duration, cb func(key K, waited time.Duration)) Option {
+	return func(c *config) {
+		c.starvationThreshold = threshold
+		c.onStarvation = cb
+	}
+}
+
+// WithStallDetector sets a function which is called when an item has been running for longer than threshold, such as
+// work which is hung on a bug and will never return.  Its key is stalled until it does, with its queue growing, and
+// the workpool can't safely stop it, but can raise the alarm.  It's called once per attempt at an item, from a
+// goroutine of its own, while the item is still running, with how long it has run so far.  cb may be nil, if the stalled
+// keys are only needed by Health
+func WithStallDetector[K comparable](threshold time.Duration, cb func(key K, age time.Duration)) Option {
+	return func(c *config) {
+		c.stallThreshold = threshold
+		c.onStall = cb
+	}
+}
+
+// WithHealthQueueThreshold makes Health report the workpool unhealthy while more than n items are queued (see QueueLen).
+// By default the queue length doesn't affect health
+func WithHealthQueueThreshold(n uint64) Option {
+	return func(c *config) {
+		c.healthQueueLen = n
+	}
+}
+
+// WithMaxTotalQueue limits how many items may be submitted but not yet finished across all keys, so that a burst of work
+// can't exhaust memory.  Once the limit is reached, Submit blocks until an item finishes, and TrySubmit returns false.
+// SubmitBatch blocks until the whole batch fits.  By default there is no limit
+func WithMaxTotalQueue(n int) Option {
+	return func(c *config) {
+		c.maxTotalQueue = n
+	}
+}
+
+// WithMaxQueueBytes limits how many bytes of work may be submitted but not yet finished across all keys, like
+// WithMaxTotalQueue does for items, for work whose payloads vary too much in size for an item count to bound memory
+// (see SizedWork).  Once the limit is reached, Submit blocks until enough work finishes, and TrySubmit returns false.
+// Work which isn't SizedWork is free, and work larger than the limit counts as the whole limit, so that it can still be
+// submitted.  By default there is no limit
+func WithMaxQueueBytes(n int64) Option {
+	return func(c *config) {
+		c.maxQueueBytes = n
+	}
+}
+
+// WithMaxTrackedKeys bounds the memory held for keys which have gone quiet.  Each key is tracked from its first work until
+// its management goroutine has been idle for the idle timeout (see WithIdleTimeout).  Once more than n keys are tracked,
+// the least recently used idle keys are evicted early, as if they had timed out.  Keys with work queued or running are
+// never evicted, so more than n keys are tracked while more than n are busy.  By default idle keys are only evicted by
+// the idle timeout
+func WithMaxTrackedKeys(n int) Option {
+	return func(c *config) {
+		c.maxTrackedKeys = n
+	}
+}
+
+// WithUnorderedKey relaxes the ordering of the given key's work for throughput: up to parallelism items for the key may
+// run at once, rather than one at a time.  Items still start in the order they were queued, but may finish in any
+// order.  It may be given once for each unordered key.  By default every key is strictly ordered (but see
+// WithPerKeyConcurrency)
+func WithUnorderedKey[K comparable](key K, parallelism int) Option {
+	return func(c *config) {
+		if c.unordered == nil {
+			c.unordered = map[interface{}]int{}
+		}
+		c.unordered[key] = max(parallelism, 1)
+	}
+}
+
+// WithPerKeyConcurrency relaxes the ordering of every key's work as WithUnorderedKey does for one: up to n items for each
+// key may run at once.  Items still start in the order they were queued, but above 1 they may finish in any order, so
+// it suits keys which only need rough ordering.  Keys given to WithUnorderedKey keep their own parallelism.  The default
+// is 1, which runs each key's work strictly in order
+func WithPerKeyConcurrency(n int) Option {
+	return func(c *config) {
+		c.perKeyConcurrency = n
+	}
+}
+
+// WithMaxQueueDepth limits how many items TrySubmit allows to be queued for a single key.  Submit is not limited
+func WithMaxQueueDepth(n int) Option {
+	return func(c *config) {
+		c.maxQueueDepth = n
+	}
+}
+
+// WithRetry makes the workpool retry an ErrWork which returns an error, up to maxAttempts times in total.  Before each
+// retry, the work waits for backoff(attempt) at the head of its key's queue, where attempt is the number of times it
+// has failed so far.  Nothing else queued for the key runs in the meantime, so ordering is preserved.  Only the error
+// from the final attempt is delivered on the Errors channel.  A nil backoff retries immediately.
+// By default, ErrWork is attempted once
+func WithRetry(maxAttempts int, backoff func(attempt int) time.Duration) Option {
+	return func(c *config) {
+		c.retryAttempts = maxAttempts
+		c.retryBackoff = backoff
+		if backoff == nil {
+			c.retryBackoff = noBackoff
+		}
+	}
+}
+
+func noBackoff(int) time.Duration {
+	return 0
+}
+
+// WithCircuitBreaker stops hammering a failing downstream: once failThreshold items in a row have failed for a key, the
+// key's circuit breaker opens, and for the cooldown its queued work is failed fast rather than run.  Each such item is
+// reported as an ErrCircuitOpen on the Errors channel.  After the cooldown, the next item is let through: if it
+// succeeds the breaker closes, and if it fails the breaker opens again.  An item fails if an ErrWork returns an error
+// once out of retries (see WithRetry), or if a Do panics.  A key's breaker outlives its management goroutine.
+// By default there is no circuit breaker
+func WithCircuitBreaker(failThreshold int, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.breakerThreshold = failThreshold
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithKeyRateLimit limits the rate at which work starts for each key, as given by the function.  The function is called
+// once when a key is first seen, and the resulting limiter lives for as long as the key's state does.  Return rate.Inf
+// for keys which shouldn't be limited.  By default no key is limited
+func WithKeyRateLimit[K comparable](limit func(key K) rate.Limit) Option {
+	return func(c *config) {
+		c.keyRateLimit = limit
+	}
+}
+
+// WithOnComplete sets a function to be called each time a Do returns, with the work's key and the time spent in Do.
+// It is also called after a panicking Do, once the panic handler returns.  It is called from the work's goroutine after
+// the key has been released, so a slow callback doesn't hold up the key's next item.  Note that this means each item
+// is run in a goroutine of its own, rather than in its key's management goroutine
+func WithOnComplete[K comparable](f func(key K, duration time.Duration)) Option {
+	return func(c *config) {
+		c.onComplete = f
+	}
+}
+
+// WithKeyOrdering chooses the order each key's work runs in, as the key is set up.  A LIFO key gives up the workpool's
+// guarantee of running work in the order it was submitted: each new item jumps ahead of the key's queued work, so
+// runs next once the item already running, if any, has returned.  Work still runs one item at a time, PriorityWork
+// still runs by priority, with LIFO only ordering work of the same priority, and retried work (see WithRetry) still
+// runs again before anything else.  Work which yields (see SubmitResumable) on a LIFO key is the newest, so runs again
+// straight away.  A batch (see SubmitBatch and SubmitStream) and Flush's marker are queued behind the key's work as on a
+// FIFO key, so that the batch keeps its order, and Flush waits for everything before it.  A Queue from
+// WithQueueFactory orders work itself, so isn't affected
+func WithKeyOrdering[K comparable](f func(key K) Ordering) Option {
+	return func(c *config) {
+		c.keyOrdering = f
+	}
+}
+
+// WithAuditSink sets a function to be called with a record of each item once it has run, carrying the item's sequence
+// number, for an audit trail which proves the order work ran in.  Sequence numbers are handed out as work is queued, so
+// a key's records arrive in sequence, except where PriorityWork jumps the queue.  The function is called before the key
+// moves on to its next item, so that a key's records arrive in the order its work ran, which means a slow sink holds up
+// the key.  It's called after a panicking Do too, but not for work which is dropped without running
+func WithAuditSink[K comparable](f func(KeyedAuditRecord[K])) Option {
+	return func(c *config) {
+		c.auditSink = f
+	}
+}
+
+// WithOnCompleteTimings is like WithOnComplete, but the function is also given how long the work waited before its Do
+// started, which tells a slow pool apart from slow work.  The wait runs from when the work was submitted, and covers
+// time spent behind the key's earlier work, waiting on the rate limit (see WithKeyRateLimit), and waiting for a slot
+// (see WithMaxConcurrency).  A retried ErrWork's wait is counted from when it was first submitted.  Work held by a
+// Queue from WithQueueFactory isn't timestamped, so its wait is always 0
+func WithOnCompleteTimings[K comparable](f func(key K, queueWait, execTime time.Duration)) Option {
+	return func(c *config) {
+		c.onCompleteTimings = f
+	}
+}
+
+// WithOnKeyIdle sets a function called once each time a key goes fully idle: its queue has been empty for the idle
+// timeout (see WithIdleTimeout), its management goroutine is exiting, and the workpool has released its state for the
+// key.  This is the place to release any per-key resources, such as connections.  The function is called from the
+// exiting goroutine, outside of any lock.  Work submitted for the key while the function runs starts the key afresh,
+// so the function may overlap with that work
+func WithOnKeyIdle[K comparable](f func(key K)) Option {
+	return func(c *config) {
+		c.onKeyIdle = f
+	}
+}
+
+// WithTracer enables tracing: a span named "workpool.Do" is created for each item, covering both the time it spent
+// queued and the time spent in Do.  A "dequeued" event marks the end of queueing, and a "started" event the start of Do.
+// The span is a child of the span in a TracedWork's context, and records the key and the depth of the key's queue at the
+// time the item was dequeued.  By default tracing is disabled
+func WithTracer(t trace.Tracer) Option {
+	return func(c *config) {
+		c.tracer = t
+	}
+}
+
+// WithLogger sets the logger which receives debug logs as keys are set up and torn down, and as their work is dequeued
+// and completed.  By default nothing is logged
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// WithDedupe collapses consecutive DedupeWork with the same DedupeID queued for a key, so that only the latest runs.
+// See DedupeWork for details.  By default every submitted item runs
+func WithDedupe() Option {
+	return func(c *config) {
+		c.dedupe = true
+	}
+}
+
+// WithReorderWindow runs each key's SequencedWork in sequence order, for work which may be submitted out of order, such as
+// messages carrying offsets.  Work which arrives late goes ahead of any queued work with a higher sequence number.  A key
+// holds back SequencedWork which may not be next, waiting for the missing work for up to d from when the earliest of the
+// queued SequencedWork was submitted, after which it gives up on the gap and carries on in order.  Once a key has run a
+// SequencedWork, the one numbered after it is next, and runs at once, but a key which goes idle forgets its place, so
+// its first SequencedWork always waits out the window.  SequencedWork runs ahead of other work with the same priority
+// that was submitted after it.  It has no effect on a LIFO key (see WithKeyOrdering), on a Queue from WithQueueFactory,
+// or with WithSynchronous
+func WithReorderWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.reorderWindow = d
+	}
+}
+
+// WithWorkTimeout bounds how long each item may run.  ContextWork is handed a context which is cancelled once it has
+// run for d.  Other work can't be interrupted, so it is left to finish, but an ErrWorkTimeout is delivered on the
+// Errors channel as soon as it overruns.  ContextWork which overruns is reported the same way.  By default work may run
+// indefinitely
+func WithWorkTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.workTimeout = d
+	}
+}
+
+// WithQueueTTL drops work which has waited in its key's queue for longer than d by the time it reaches the head of the
+// queue, so that a long backlog doesn't process stale work.  Each dropped item is reported as an ErrWorkExpired on the
+// Errors channel.  A retried ErrWork's wait is counted from when it was first submitted.  By default work never expires
+func WithQueueTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.queueTTL = d
+	}
+}
+
+// WithQueueFactory replaces the built-in queue: the factory is called for each newly seen key, and the Queue it returns
+// holds that key's waiting work.  The pool serializes its calls into each Queue.  A Queue holds only the work itself,
+// so the features which track work while it waits are lost: PriorityWork and DelayedWork are left to the Queue,
+// WithDedupe, WithQueueTTL and SubmitCtx's context have no effect, and SnapshotWork can't see into the Queue.  The Queue
+// is handed the submitted work itself, and must hand back the values it was given, rather than rebuilt ones, for a
+// Result (see SubmitResult) or cancellation (see Submit) to follow work which can't be compared.  By default each key
+// has the built-in queue
+func WithQueueFactory[K comparable](factory func(key K) KeyedQueue[K]) Option {
+	return func(c *config) {
+		c.queueFactory = factory
+	}
+}
+
+// WithLockProvider serializes each key's work across every workpool sharing the provider, such as pools in different
+// processes sharing a distributed lock.  Each item acquires its key's lock from the provider just before it runs, and
+// releases it once it's done, so a key's work is never run by two pools at once.  Work which can't acquire the lock is
+// dropped, with the provider's error reported on the Errors channel and given to its Result.  Unordered keys (see
+// WithUnorderedKey) aren't locked.  By default keys are only serialized within the pool.
+// For a KeyedWorkpool whose keys aren't strings, use WithKeyedLockProvider
+func WithLockProvider(p LockProvider) Option {
+	return WithKeyedLockProvider[string](p)
+}
+
+// WithKeyedLockProvider is WithLockProvider for a KeyedWorkpool of any type of key
+func WithKeyedLockProvider[K comparable](p KeyedLockProvider[K]) Option {
+	return func(c *config) {
+		c.lockProvider = p
+	}
+}
+
+// discardHandler is a slog.Handler which is never enabled
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
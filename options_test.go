@@ -0,0 +1,1071 @@
+package workpool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewDefaults(t *testing.T) {
+	sut := New()
+	assert.Equal(t, 100*time.Millisecond, sut.cfg.idleTimeout)
+	assert.Equal(t, 100, cap(sut.Errors()))
+	assert.NotNil(t, sut.hooks.panicHandler)
+}
+
+func TestOptionsApplyInOrder(t *testing.T) {
+	sut := New(WithIdleTimeout(time.Second), WithIdleTimeout(time.Minute))
+	assert.Equal(t, time.Minute, sut.cfg.idleTimeout)
+}
+
+func TestErrorBufferDoesNotBlock(t *testing.T) {
+	sut := New(WithErrorBuffer(1))
+	for i := 0; i < 3; i++ {
+		sut.SubmitErr(errWrk{k: "key", d: func() error { return errors.New("boom") }})
+	}
+	// nobody is reading the errors, but the work still completes
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Len(t, sut.Errors(), 1)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	short := New(WithIdleTimeout(5 * time.Millisecond))
+	long := New(WithIdleTimeout(time.Minute))
+	for _, sut := range []*Workpool{short, long} {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		sut.Submit(wrk{k: "key", d: wg.Done})
+		wg.Wait()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, short.Keys())
+	assert.Equal(t, []string{"key"}, long.Keys())
+
+	// shutting down still wakes the long-lived manager
+	assert.NoError(t, long.Shutdown(context.Background()))
+	assert.Eventually(t, func() bool { return len(long.Keys()) == 0 }, 50*time.Millisecond, time.Millisecond)
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	sut := New(WithIdleTimeout(time.Minute))
+	sut.SetIdleTimeout(5 * time.Millisecond)
+	sut.Submit(wrk{k: "short", d: func() {}})
+	assert.Eventually(t, func() bool { return len(sut.Keys()) == 0 }, time.Second, time.Millisecond)
+
+	sut.SetIdleTimeout(time.Minute)
+	r := sut.SubmitResult(wrk{k: "long", d: func() {}})
+	r.Wait()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"long"}, sut.Keys())
+
+	// a negative timeout is taken as 0, retiring keys as soon as they're idle
+	sut.SetIdleTimeout(-time.Second)
+	assert.Equal(t, time.Duration(0), sut.idleTimeout())
+	sut.SubmitResult(wrk{k: "none", d: func() {}}).Wait()
+	assert.Eventually(t, func() bool { return len(sut.Keys()) == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestIdleJitter(t *testing.T) {
+	assert.Equal(t, 100*time.Millisecond, New(WithIdleTimeout(100*time.Millisecond)).idleTimeout())
+
+	sut := New(WithIdleTimeout(100*time.Millisecond), WithIdleJitter(0.5))
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := sut.idleTimeout()
+		assert.GreaterOrEqual(t, d, 100*time.Millisecond)
+		assert.LessOrEqual(t, d, 150*time.Millisecond)
+		seen[d] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	// jitter can't overflow a huge timeout, nor apply to a timeout of 0 or less
+	sut.SetIdleTimeout(time.Duration(math.MaxInt64 - 1))
+	assert.GreaterOrEqual(t, sut.idleTimeout(), time.Duration(math.MaxInt64-1))
+	sut.SetIdleTimeout(0)
+	assert.Equal(t, time.Duration(0), sut.idleTimeout())
+	sut.SetIdleTimeout(-time.Second)
+	assert.Equal(t, time.Duration(0), sut.idleTimeout())
+
+	assert.Panics(t, func() { WithIdleJitter(-0.5) })
+	assert.Panics(t, func() { WithIdleJitter(math.NaN()) })
+}
+
+// BenchmarkIdleKeys measures the cost of 10k mostly-idle keys going idle and being torn down, with and without jitter
+// to spread them out.  Each key has a single item, then idles until its manager exits
+func BenchmarkIdleKeys(b *testing.B) {
+	const keys = 10000
+	for _, jitter := range []float64{0, 0.5} {
+		b.Run(fmt.Sprintf("jitter=%v", jitter), func(b *testing.B) {
+			sut := New(WithIdleTimeout(10*time.Millisecond), WithIdleJitter(jitter))
+			var idle time.Duration
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				wg.Add(keys)
+				for k := 0; k < keys; k++ {
+					sut.SubmitFunc(strconv.Itoa(k), wg.Done)
+				}
+				wg.Wait()
+				// the work is done, so all that's left is every key going idle, and its manager exiting
+				start := time.Now()
+				sut.Wait()
+				idle += time.Since(start)
+			}
+			b.ReportMetric(float64(idle)/float64(b.N), "idle-ns/op")
+			assert.NoError(b, sut.Shutdown(context.Background()))
+		})
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	n := int64(3)
+	sut := New(WithMaxConcurrency(int(n)))
+	var running, maxRunning int64
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 2; j++ {
+			sut.Submit(wrk{k: strconv.Itoa(i), d: func() {
+				r := atomic.AddInt64(&running, 1)
+				for m := atomic.LoadInt64(&maxRunning); r > m && !atomic.CompareAndSwapInt64(&maxRunning, m, r); {
+					m = atomic.LoadInt64(&maxRunning)
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt64(&running, -1)
+			}})
+		}
+	}
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, n, atomic.LoadInt64(&maxRunning))
+}
+
+type weightedWrk struct {
+	wrk
+	weight int64
+}
+
+func (w weightedWrk) Weight() int64 {
+	return w.weight
+}
+
+func TestWeightedWork(t *testing.T) {
+	n := int64(5)
+	sut := New(WithMaxConcurrency(int(n)))
+	var running, maxRunning int64
+	// weights beyond the limit are clamped to it, and those below 1 count as 1
+	weights := []int64{1, 2, 4, 0, 10}
+	for i := 0; i < 20; i++ {
+		w := weights[i%len(weights)]
+		clamped := min(max(w, 1), n)
+		sut.Submit(weightedWrk{wrk: wrk{k: strconv.Itoa(i), d: func() {
+			r := atomic.AddInt64(&running, clamped)
+			for m := atomic.LoadInt64(&maxRunning); r > m && !atomic.CompareAndSwapInt64(&maxRunning, m, r); {
+				m = atomic.LoadInt64(&maxRunning)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&running, -clamped)
+		}}, weight: w})
+	}
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.LessOrEqual(t, atomic.LoadInt64(&maxRunning), n)
+	assert.Greater(t, atomic.LoadInt64(&maxRunning), int64(1))
+}
+
+func TestMaxQueueDepth(t *testing.T) {
+	sut := New(WithMaxQueueDepth(2))
+	started := make(chan struct{}, 4)
+	block := make(chan struct{})
+	blocked := wrk{k: "key", d: func() {
+		started <- struct{}{}
+		<-block
+	}}
+
+	assert.True(t, sut.TrySubmit(blocked))
+	<-started
+	assert.True(t, sut.TrySubmit(blocked))
+	assert.True(t, sut.TrySubmit(blocked))
+	assert.False(t, sut.TrySubmit(blocked))
+	assert.Equal(t, 2, sut.KeyQueueLen("key"))
+
+	// other keys have their own depth
+	assert.True(t, sut.TrySubmit(wrk{k: "other", d: func() {}}))
+	// and Submit is unbounded
+	sut.Submit(blocked)
+	assert.Equal(t, 3, sut.KeyQueueLen("key"))
+
+	// once running items complete, the next are dequeued and there's room again
+	for i := 0; i < 2; i++ {
+		block <- struct{}{}
+		<-started
+	}
+	assert.True(t, sut.TrySubmit(wrk{k: "key", d: func() {}}))
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestRetry(t *testing.T) {
+	var backoffs []int
+	sut := New(WithRetry(3, func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return 10 * time.Millisecond
+	}))
+
+	var runs []string
+	attempts := 0
+	start := time.Now()
+	sut.SubmitErr(errWrk{k: "key", d: func() error {
+		runs = append(runs, "flaky")
+		attempts++
+		if attempts < 3 {
+			return errors.New("boom")
+		}
+		return nil
+	}})
+	sut.Submit(wrk{k: "key", d: func() { runs = append(runs, "next") }})
+	sut.SubmitErr(errWrk{k: "key", d: func() error {
+		runs = append(runs, "broken")
+		return errors.New("broken")
+	}})
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	assert.Equal(t, []string{"flaky", "flaky", "flaky", "next", "broken", "broken", "broken"}, runs)
+	assert.Equal(t, []int{1, 2, 1, 2}, backoffs)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	var errs []KeyError
+	for err := range sut.Errors() {
+		errs = append(errs, err)
+	}
+	if assert.Len(t, errs, 1) {
+		assert.EqualError(t, errs[0].Err, "broken")
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	sut := New(WithKeyRateLimit(func(key string) rate.Limit {
+		if key == "limited" {
+			return 100
+		}
+		return rate.Inf
+	}))
+
+	start := time.Now()
+	var limitedDone, unlimitedDone time.Duration
+	for i := 0; i < 10; i++ {
+		sut.Submit(wrk{k: "limited", d: func() { limitedDone = time.Since(start) }})
+		sut.Submit(wrk{k: "unlimited", d: func() { unlimitedDone = time.Since(start) }})
+	}
+	sut.Wait()
+
+	// the first item uses the burst, and the other nine are spread 10ms apart
+	assert.GreaterOrEqual(t, limitedDone, 90*time.Millisecond)
+	assert.Less(t, unlimitedDone, 50*time.Millisecond)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	sut := New(WithCircuitBreaker(2, 50*time.Millisecond))
+	boom := errors.New("boom")
+	var calls int
+	failing := errWrk{k: "key", d: func() error {
+		calls++
+		return boom
+	}}
+	sut.SubmitErr(failing)
+	sut.SubmitErr(failing)
+	// the breaker is open, so these are failed fast
+	sut.SubmitErr(failing)
+	fastFailed := sut.SubmitResult(wrk{k: "key", d: func() { calls++ }})
+	// other keys are unaffected
+	other := sut.SubmitResult(wrk{k: "other", d: func() {}})
+	fastFailed.Wait()
+	other.Wait()
+	assert.Equal(t, 2, calls)
+	assert.ErrorIs(t, fastFailed.Err(), ErrCircuitOpen)
+	assert.NoError(t, other.Err())
+
+	// once the cooldown is over, a success closes the breaker again
+	time.Sleep(60 * time.Millisecond)
+	recovered := sut.SubmitResult(wrk{k: "key", d: func() { calls++ }})
+	sut.SubmitErr(failing)
+	after := sut.SubmitResult(wrk{k: "key", d: func() { calls++ }})
+	after.Wait()
+	assert.NoError(t, recovered.Err())
+	assert.NoError(t, after.Err())
+	assert.Equal(t, 5, calls)
+
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	var errs []error
+	for err := range sut.Errors() {
+		errs = append(errs, err.Err)
+	}
+	assert.Equal(t, []error{boom, boom, ErrCircuitOpen, ErrCircuitOpen, boom}, errs)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	sut := New(WithCircuitBreaker(1, 20*time.Millisecond))
+	var calls int
+	failing := errWrk{k: "key", d: func() error {
+		calls++
+		return errors.New("boom")
+	}}
+	sut.SubmitErr(failing)
+	sut.Wait()
+	time.Sleep(30 * time.Millisecond)
+	// the trial item fails, so the breaker opens again straight away
+	sut.SubmitErr(failing)
+	r := sut.SubmitResult(wrk{k: "key", d: func() { calls++ }})
+	r.Wait()
+	assert.Equal(t, 2, calls)
+	assert.ErrorIs(t, r.Err(), ErrCircuitOpen)
+}
+
+func TestOnComplete(t *testing.T) {
+	var mtx sync.Mutex
+	durations := map[string][]time.Duration{}
+	sut := New(
+		WithPanicHandler(func(Work, interface{}, []byte) {}),
+		WithOnComplete(func(key string, d time.Duration) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			durations[key] = append(durations[key], d)
+		}),
+	)
+	sut.Submit(wrk{k: "slow", d: func() { time.Sleep(20 * time.Millisecond) }})
+	sut.Submit(wrk{k: "slow", d: func() { panic("boom") }})
+	sut.Submit(wrk{k: "fast", d: func() {}})
+	sut.Wait()
+
+	assert.Len(t, durations["slow"], 2)
+	assert.GreaterOrEqual(t, durations["slow"][0], 20*time.Millisecond)
+	assert.Len(t, durations["fast"], 1)
+	assert.Less(t, durations["fast"][0], 20*time.Millisecond)
+}
+
+func TestOnCompleteDoesNotStallKey(t *testing.T) {
+	release := make(chan struct{})
+	sut := New(WithOnComplete(func(string, time.Duration) { <-release }))
+	ran := make(chan struct{}, 2)
+	sut.Submit(wrk{k: "key", d: func() { ran <- struct{}{} }})
+	sut.Submit(wrk{k: "key", d: func() { ran <- struct{}{} }})
+	// both items run even though the first callback hasn't returned
+	<-ran
+	<-ran
+	close(release)
+	sut.Wait()
+}
+
+func TestOnCompleteTimings(t *testing.T) {
+	type timing struct{ queueWait, execTime time.Duration }
+	var mtx sync.Mutex
+	var timings []timing
+	sut := New(WithOnCompleteTimings(func(key string, queueWait, execTime time.Duration) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		timings = append(timings, timing{queueWait, execTime})
+	}))
+	// the first item stalls the key, so everything behind it waits
+	sut.Submit(wrk{k: "key", d: func() { time.Sleep(50 * time.Millisecond) }})
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "key", d: func() {}})
+	}
+	sut.Wait()
+
+	assert.Len(t, timings, 4)
+	assert.Less(t, timings[0].queueWait, 50*time.Millisecond)
+	assert.GreaterOrEqual(t, timings[0].execTime, 50*time.Millisecond)
+	for _, tm := range timings[1:] {
+		assert.GreaterOrEqual(t, tm.queueWait, 50*time.Millisecond)
+		assert.Less(t, tm.execTime, 50*time.Millisecond)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	sut := New(
+		WithIdleTimeout(20*time.Millisecond),
+		WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	sut.Submit(wrk{k: "key", d: func() {}})
+	sut.Wait()
+
+	var msgs []string
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		assert.Contains(t, string(line), "key=key")
+		msgs = append(msgs, string(line[bytes.Index(line, []byte("msg=")):bytes.Index(line, []byte(" key="))]))
+	}
+	assert.Equal(t, []string{
+		`msg="workpool: key first seen"`,
+		`msg="workpool: manager started"`,
+		`msg="workpool: work dequeued"`,
+		`msg="workpool: work completed"`,
+		`msg="workpool: manager exiting after idle timeout"`,
+	}, msgs)
+}
+
+func TestNoLoggerDoesNotAllocate(t *testing.T) {
+	sut := New()
+	allocs := testing.AllocsPerRun(100, func() {
+		sut.debug("workpool: test", "key")
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+type dedupeWrk struct {
+	wrk
+	id string
+}
+
+func (w dedupeWrk) DedupeID() string {
+	return w.id
+}
+
+func TestDedupe(t *testing.T) {
+	for _, dedupe := range []bool{true, false} {
+		var opts []Option
+		if dedupe {
+			opts = append(opts, WithDedupe())
+		}
+		sut := New(opts...)
+		block := make(chan struct{})
+		started := make(chan struct{})
+		var ran []string
+		record := func(name string) func() {
+			return func() { ran = append(ran, name) }
+		}
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: func() {
+			close(started)
+			<-block
+			ran = append(ran, "running")
+		}}, id: "a"})
+		<-started
+
+		// the running item is never collapsed into
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("a1")}, id: "a"})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("a2")}, id: "a"})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("a3")}, id: "a"})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("b1")}, id: "b"})
+		sut.Submit(wrk{k: "key", d: record("plain")})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("b2")}, id: "b"})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("a4")}, id: "a"})
+		sut.Submit(dedupeWrk{wrk: wrk{k: "key", d: record("a5")}, id: "a"})
+		// other keys run concurrently, so record them separately
+		otherRan := make(chan struct{}, 1)
+		sut.Submit(dedupeWrk{wrk: wrk{k: "other", d: func() { otherRan <- struct{}{} }}, id: "a"})
+		if dedupe {
+			assert.Equal(t, uint64(7), sut.QueueLen())
+		}
+		close(block)
+		sut.Wait()
+
+		if dedupe {
+			assert.Equal(t, []string{"running", "a3", "b1", "plain", "b2", "a5"}, ran)
+		} else {
+			assert.Equal(t, []string{"running", "a1", "a2", "a3", "b1", "plain", "b2", "a4", "a5"}, ran)
+		}
+		assert.Len(t, otherRan, 1)
+	}
+}
+
+func TestWorkTimeout(t *testing.T) {
+	sut := New(WithWorkTimeout(20 * time.Millisecond))
+	var elapsed time.Duration
+	sut.SubmitContext(ctxWrk{k: "ctx", d: func(ctx context.Context) {
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		elapsed = time.Since(start)
+	}})
+	finished := false
+	sut.Submit(wrk{k: "plain", d: func() {
+		time.Sleep(60 * time.Millisecond)
+		finished = true
+	}})
+	sut.Submit(wrk{k: "fast", d: func() {}})
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	assert.Less(t, elapsed, time.Second)
+	assert.True(t, finished, "work which can't be interrupted should run to completion")
+	keys := map[string]error{}
+	for err := range sut.Errors() {
+		keys[err.Key] = err.Err
+	}
+	assert.Equal(t, map[string]error{"ctx": ErrWorkTimeout, "plain": ErrWorkTimeout}, keys)
+}
+
+func TestDropWhileBusy(t *testing.T) {
+	sut := New(WithDropWhileBusy(), WithEvents())
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran int32
+	sut.Submit(wrk{k: "busy", d: func() {
+		close(started)
+		<-block
+		atomic.AddInt32(&ran, 1)
+	}})
+	<-started
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "busy", d: func() { atomic.AddInt32(&ran, 1) }})
+	}
+	r := sut.SubmitResult(wrk{k: "busy", d: func() { atomic.AddInt32(&ran, 1) }})
+	r.Wait()
+	assert.ErrorIs(t, r.Err(), ErrWorkDropped)
+	// other keys are unaffected
+	sut.Submit(wrk{k: "other", d: func() { atomic.AddInt32(&ran, 1) }})
+	close(block)
+	sut.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ran))
+	assert.Equal(t, uint64(4), sut.Stats().BusyDrops)
+
+	// once the key's work has finished, it takes more
+	sut.Submit(wrk{k: "busy", d: func() { atomic.AddInt32(&ran, 1) }})
+	sut.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ran))
+	dropped := 0
+	for len(sut.Events()) > 0 {
+		if e := <-sut.Events(); e.Type == ItemDropped {
+			assert.Equal(t, "busy", e.Key)
+			dropped++
+		}
+	}
+	assert.Equal(t, 4, dropped)
+
+	// a flush waits for the key's work rather than being dropped
+	block = make(chan struct{})
+	var finished int32
+	sut.Submit(wrk{k: "busy", d: func() {
+		<-block
+		atomic.StoreInt32(&finished, 1)
+	}})
+	flushed := make(chan struct{})
+	go func() {
+		sut.Flush("busy")
+		close(flushed)
+	}()
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("busy") == 1 }, time.Second, time.Millisecond)
+	close(block)
+	<-flushed
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished))
+
+	// a stream is taken whole by an idle key, and dropped whole by a busy one
+	var results []int
+	for r := range SubmitStream(sut, "busy", []func() int{func() int { return 1 }, func() int { return 2 }}) {
+		results = append(results, r)
+	}
+	assert.Equal(t, []int{1, 2}, results)
+	block = make(chan struct{})
+	sut.Submit(wrk{k: "busy", d: func() { <-block }})
+	_, open := <-SubmitStream(sut, "busy", []func() int{func() int { return 1 }, func() int { return 2 }})
+	assert.False(t, open)
+	close(block)
+	sut.Wait()
+}
+
+func TestStallDetector(t *testing.T) {
+	stalled := make(chan string, 10)
+	sut := New(WithStallDetector(20*time.Millisecond, func(key string, age time.Duration) {
+		assert.GreaterOrEqual(t, age, 20*time.Millisecond)
+		stalled <- key
+	}))
+	hung := make(chan struct{})
+	sut.Submit(wrk{k: "hung", d: func() { <-hung }})
+	sut.Submit(wrk{k: "fast", d: func() {}})
+
+	select {
+	case key := <-stalled:
+		assert.Equal(t, "hung", key)
+	case <-time.After(time.Second):
+		t.Fatal("stall went undetected")
+	}
+	// the work is left running, holding up its key
+	assert.Equal(t, uint64(1), sut.QueueLen())
+	close(hung)
+	sut.Wait()
+	// once per item
+	assert.Empty(t, stalled)
+}
+
+func TestOnKeyIdle(t *testing.T) {
+	var mtx sync.Mutex
+	idled := map[string]int{}
+	var sut *Workpool
+	sut = New(
+		WithIdleTimeout(5*time.Millisecond),
+		WithOnKeyIdle(func(key string) {
+			mtx.Lock()
+			idled[key]++
+			n := idled[key]
+			mtx.Unlock()
+			// the key's state is gone, so more work starts it afresh
+			if key == "a" && n == 1 {
+				sut.Submit(wrk{k: "a", d: func() {}})
+			}
+		}),
+	)
+	for i := 0; i < 10; i++ {
+		sut.Submit(wrk{k: "a", d: func() {}})
+		sut.Submit(wrk{k: "b", d: func() {}})
+	}
+	sut.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, idled)
+	assert.Empty(t, sut.Keys())
+}
+
+func TestQueueTTL(t *testing.T) {
+	sut := New(WithQueueTTL(30 * time.Millisecond))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []string
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "stale1") }})
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "stale2") }})
+	time.Sleep(50 * time.Millisecond)
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "fresh") }})
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	assert.Equal(t, []string{"fresh"}, ran)
+	var errs []KeyError
+	for err := range sut.Errors() {
+		errs = append(errs, err)
+	}
+	assert.Equal(t, []KeyError{{Key: "key", Err: ErrWorkExpired}, {Key: "key", Err: ErrWorkExpired}}, errs)
+}
+
+func TestMaxTotalQueue(t *testing.T) {
+	sut := New(WithMaxTotalQueue(5))
+	block := make(chan struct{})
+	started := make(chan struct{}, 5)
+	blocked := wrk{k: "key", d: func() {
+		started <- struct{}{}
+		<-block
+	}}
+	for i := 0; i < 5; i++ {
+		sut.Submit(blocked)
+	}
+	<-started
+	assert.False(t, sut.TrySubmit(wrk{k: "other", d: func() {}}))
+
+	// the sixth item shares the key of the items holding up the queue
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		sut.Submit(blocked)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("Submit didn't block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, 4, sut.KeyQueueLen("key"))
+
+	block <- struct{}{}
+	<-submitted
+	assert.PanicsWithValue(t, ErrBatchTooLarge, func() { sut.SubmitBatch(make([]Work, 6)) })
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Len(t, started, 5)
+}
+
+type sizedWrk struct {
+	wrk
+	size int64
+}
+
+func (w sizedWrk) Size() int64 {
+	return w.size
+}
+
+func TestMaxQueueBytes(t *testing.T) {
+	sut := New(WithMaxQueueBytes(100))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	fill := func(size int64) int {
+		n := 0
+		for sut.TrySubmit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: size}) {
+			n++
+		}
+		return n
+	}
+	// large items trip the limit sooner than small ones
+	assert.Equal(t, 10, fill(10))
+	assert.Equal(t, int64(100), sut.Stats().QueuedBytes)
+	close(block)
+	sut.Wait()
+	assert.Equal(t, int64(0), sut.Stats().QueuedBytes)
+
+	block = make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+	assert.Equal(t, 2, fill(40))
+	// work larger than the limit counts as the whole limit, so fits once the rest is done
+	assert.False(t, sut.TrySubmit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 1000}))
+	assert.PanicsWithValue(t, ErrBatchTooLarge, func() {
+		sut.SubmitBatch([]Work{sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 60}, sizedWrk{size: 60}})
+	})
+	close(block)
+	sut.Wait()
+	assert.True(t, sut.TrySubmit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 1000}))
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, int64(0), sut.Stats().QueuedBytes)
+
+	// replacing queued work moves its room over to the replacement
+	sut = New(WithMaxQueueBytes(100))
+	sut.Pause("key")
+	sut.Submit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 10})
+	sut.Submit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 50})
+	assert.True(t, sut.ReplaceHead("key", sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 40}))
+	assert.Equal(t, int64(90), sut.Stats().QueuedBytes)
+	assert.False(t, sut.ReplaceHead("key", sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 60}))
+	assert.True(t, sut.ReplaceHead("key", sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 5}))
+	assert.Equal(t, int64(55), sut.Stats().QueuedBytes)
+	assert.True(t, sut.TrySubmit(sizedWrk{wrk: wrk{k: "key", d: func() {}}, size: 45}))
+	sut.Resume("key")
+	sut.Wait()
+	assert.Equal(t, int64(0), sut.Stats().QueuedBytes)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestMaxTrackedKeys(t *testing.T) {
+	// long enough that only eviction can explain keys being untracked
+	sut := New(WithMaxTrackedKeys(100), WithIdleTimeout(time.Minute))
+	for i := 0; i < 1000; i++ {
+		sut.SubmitResult(wrk{k: strconv.Itoa(i), d: func() {}}).Wait()
+	}
+	assert.Eventually(t, func() bool { return sut.Stats().TrackedKeys <= 100 }, time.Second, time.Millisecond)
+
+	// the most recently used keys are the ones kept
+	assert.Contains(t, sut.Keys(), "999")
+	sut.Close()
+}
+
+func TestUnorderedKey(t *testing.T) {
+	sut := New(WithUnorderedKey("unordered", 4), WithIdleTimeout(5*time.Millisecond))
+	maxOverlap := map[string]*int64{"unordered": new(int64), "ordered": new(int64)}
+	for key, maxRunning := range maxOverlap {
+		var running int64
+		for i := 0; i < 12; i++ {
+			sut.Submit(wrk{k: key, d: func() {
+				r := atomic.AddInt64(&running, 1)
+				for m := atomic.LoadInt64(maxRunning); r > m && !atomic.CompareAndSwapInt64(maxRunning, m, r); {
+					m = atomic.LoadInt64(maxRunning)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt64(&running, -1)
+			}})
+		}
+	}
+	sut.Wait()
+
+	assert.Equal(t, int64(4), atomic.LoadInt64(maxOverlap["unordered"]))
+	assert.Equal(t, int64(1), atomic.LoadInt64(maxOverlap["ordered"]))
+	assert.Empty(t, sut.Keys())
+}
+
+func TestExecutor(t *testing.T) {
+	// a bounded pool of two workers, which turns work away while they're busy, and takes it again later
+	jobs := make(chan func())
+	for i := 0; i < 2; i++ {
+		go func() {
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+	var rejected int32
+	executor := func(run func()) {
+		select {
+		case jobs <- run:
+		default:
+			atomic.AddInt32(&rejected, 1)
+			go func() {
+				time.Sleep(time.Millisecond)
+				jobs <- run
+			}()
+		}
+	}
+	sut := New(WithExecutor(executor))
+
+	const keys, items = 5, 20
+	ran := make([][]int, keys)
+	for i := 0; i < items; i++ {
+		for k := 0; k < keys; k++ {
+			sut.Submit(wrk{k: strconv.Itoa(k), d: func() {
+				time.Sleep(100 * time.Microsecond)
+				ran[k] = append(ran[k], i)
+			}})
+		}
+	}
+	sut.Wait()
+	close(jobs)
+
+	assert.Greater(t, atomic.LoadInt32(&rejected), int32(0))
+	for k := range ran {
+		if assert.Len(t, ran[k], items) {
+			for i := range ran[k] {
+				assert.Equal(t, i, ran[k][i], "key %d ran out of order", k)
+			}
+		}
+	}
+}
+
+func TestSubmitGate(t *testing.T) {
+	var open int32
+	sut := New(WithSubmitGate(func(key string) bool { return key == "always" || atomic.LoadInt32(&open) == 1 }))
+	var ran int32
+	submitted := make(chan struct{})
+	go func() {
+		sut.Submit(wrk{k: "key", d: func() { atomic.AddInt32(&ran, 1) }})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submitted through a closed gate")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.False(t, sut.TrySubmit(wrk{k: "key", d: func() {}}))
+	// the gate is asked about each key
+	sut.SubmitFunc("always", func() {})
+
+	atomic.StoreInt32(&open, 1)
+	sut.NotifyGateChanged()
+	<-submitted
+	assert.True(t, sut.TrySubmit(wrk{k: "key", d: func() { atomic.AddInt32(&ran, 1) }}))
+	sut.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ran))
+
+	// shutting down releases submissions held by the gate
+	atomic.StoreInt32(&open, 0)
+	held := make(chan interface{})
+	go func() {
+		defer func() { held <- recover() }()
+		sut.Submit(wrk{k: "key", d: func() {}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, ErrPoolClosed, <-held)
+}
+
+func TestQueueHighWatermark(t *testing.T) {
+	var mtx sync.Mutex
+	var depths []int
+	sut := New(WithQueueHighWatermark(4, func(key string, depth int) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		assert.Equal(t, "key", key)
+		depths = append(depths, depth)
+	}))
+	step := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		sut.Submit(wrk{k: "key", d: func() { <-step }})
+	}
+	// hovering around the watermark doesn't call back again
+	for i := 0; i < 3; i++ {
+		step <- struct{}{}
+		sut.Submit(wrk{k: "key", d: func() { <-step }})
+	}
+	close(step)
+	sut.Wait()
+
+	// crossed once on the way up, and recovered once on the way down
+	assert.Equal(t, []int{5, 2}, depths)
+}
+
+func TestPerKeyConcurrency(t *testing.T) {
+	sut := New(WithPerKeyConcurrency(3), WithUnorderedKey("unordered", 2))
+	var running, maxRunning int64
+	block := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		sut.Submit(wrk{k: "key", d: func() {
+			r := atomic.AddInt64(&running, 1)
+			for m := atomic.LoadInt64(&maxRunning); r > m && !atomic.CompareAndSwapInt64(&maxRunning, m, r); {
+				m = atomic.LoadInt64(&maxRunning)
+			}
+			<-block
+			atomic.AddInt64(&running, -1)
+		}})
+	}
+	// three items run at once, and no more
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&running) == 3 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&maxRunning))
+
+	// an unordered key keeps its own parallelism
+	var other int64
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "unordered", d: func() {
+			atomic.AddInt64(&other, 1)
+			<-block
+		}})
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&other) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&other))
+	close(block)
+	sut.Wait()
+	assert.Equal(t, int64(3), atomic.LoadInt64(&maxRunning))
+}
+
+func TestSynchronous(t *testing.T) {
+	sut := New(WithSynchronous())
+	var ran []string
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			name := key + strconv.Itoa(i)
+			sut.Submit(wrk{k: key, d: func() { ran = append(ran, name) }})
+			// already run, with no goroutine behind it
+			assert.Equal(t, name, ran[len(ran)-1])
+		}
+	}
+	assert.Equal(t, 0, sut.NumManagers())
+
+	// work submitted by work runs once the submitting item is done
+	sut.Submit(wrk{k: "a", d: func() {
+		sut.Submit(wrk{k: "b", d: func() { ran = append(ran, "nested") }})
+		ran = append(ran, "outer")
+	}})
+	assert.Equal(t, []string{"a0", "b0", "a1", "b1", "a2", "b2", "outer", "nested"}, ran)
+
+	// in the order it was submitted, even when the submitting item adds to its own key too
+	ran = nil
+	sut.Submit(wrk{k: "a", d: func() {
+		sut.Submit(wrk{k: "b", d: func() { ran = append(ran, "other key") }})
+		sut.Submit(wrk{k: "a", d: func() { ran = append(ran, "own key") }})
+		ran = append(ran, "outer")
+	}})
+	assert.Equal(t, []string{"outer", "other key", "own key"}, ran)
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestKeyOrdering(t *testing.T) {
+	sut := New(WithKeyOrdering(func(key string) Ordering {
+		if key == "lifo" {
+			return LIFO
+		}
+		return FIFO
+	}))
+	for _, key := range []string{"lifo", "fifo"} {
+		var ran []string
+		block := make(chan struct{})
+		started := make(chan struct{})
+		sut.Submit(wrk{k: key, d: func() {
+			close(started)
+			<-block
+		}})
+		<-started
+		for _, name := range []string{"first", "second", "third"} {
+			sut.Submit(wrk{k: key, d: func() { ran = append(ran, name) }})
+		}
+		close(block)
+		assert.NoError(t, sut.WaitKey(context.Background(), key))
+		if key == "lifo" {
+			// the newest runs first, once the running item is done
+			assert.Equal(t, []string{"third", "second", "first"}, ran)
+		} else {
+			assert.Equal(t, []string{"first", "second", "third"}, ran)
+		}
+	}
+
+	// a batch keeps its order, and a flush waits for everything before it
+	var ran []string
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "lifo", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	sut.Submit(wrk{k: "lifo", d: func() { ran = append(ran, "queued") }})
+	sut.SubmitBatch([]Work{
+		wrk{k: "lifo", d: func() { ran = append(ran, "first") }},
+		wrk{k: "lifo", d: func() { ran = append(ran, "second") }},
+	})
+	stream := SubmitStream(sut, "lifo", []func() int{func() int { return 1 }, func() int { return 2 }})
+	flushed := make(chan struct{})
+	go func() {
+		sut.Flush("lifo")
+		close(flushed)
+	}()
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("lifo") == 6 }, time.Second, time.Millisecond)
+	close(block)
+	<-flushed
+	assert.Equal(t, []string{"queued", "first", "second"}, ran)
+	var results []int
+	for r := range stream {
+		results = append(results, r)
+	}
+	assert.Equal(t, []int{1, 2}, results)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+type sequencedWrk struct {
+	wrk
+	seq int64
+}
+
+func (s sequencedWrk) Seq() int64 {
+	return s.seq
+}
+
+func TestReorderWindow(t *testing.T) {
+	// short enough to wait out
+	sut := New(WithReorderWindow(time.Millisecond), WithIdleTimeout(time.Minute))
+	var mtx sync.Mutex
+	var ran []int64
+	submit := func(sut *Workpool, s int64) {
+		sut.Submit(sequencedWrk{wrk: wrk{k: "key", d: func() {
+			mtx.Lock()
+			defer mtx.Unlock()
+			ran = append(ran, s)
+		}}, seq: s})
+	}
+
+	// late work goes ahead of what it should have come before
+	sut.Pause("key")
+	submit(sut, 2)
+	submit(sut, 1)
+	sut.Resume("key")
+	assert.NoError(t, sut.WaitKey(context.Background(), "key"))
+	// a gap is waited out, then skipped
+	submit(sut, 4)
+	assert.NoError(t, sut.WaitKey(context.Background(), "key"))
+	assert.Equal(t, []int64{1, 2, 4}, ran)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	for name, opts := range map[string][]Option{"manager": nil, "shards": {WithShards(1)}} {
+		// long enough that nothing is waited out between one submission and the next check
+		sut := New(append(opts, WithReorderWindow(500*time.Millisecond), WithIdleTimeout(time.Minute))...)
+		ran = nil
+		submit(sut, 1)
+		assert.NoError(t, sut.WaitKey(context.Background(), "key"), name)
+		// work after a gap is held back
+		submit(sut, 3)
+		assert.Equal(t, 1, sut.KeyQueueLen("key"), name)
+		// until the work filling the gap arrives, which runs first
+		submit(sut, 2)
+		assert.NoError(t, sut.WaitKey(context.Background(), "key"), name)
+		assert.Equal(t, []int64{1, 2, 3}, ran, name)
+		assert.NoError(t, sut.Shutdown(context.Background()), name)
+	}
+}
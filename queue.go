@@ -0,0 +1,418 @@
+package workpool
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// once this many slots at the front of a queue have been dequeued, and they make up at least half of the queue, the live
+// work is moved back to the front of the array so that the slots can be reused
+const compactThreshold = 64
+
+// entry is a unit of work held in a queue, along with what the pool tracks about it
+type entry[K comparable] struct {
+	work KeyedWork[K]
+	// when the work was submitted
+	enqueued time.Time
+	// the work's place in the order all work was queued in (see WithAuditSink)
+	seq uint64
+	// the context the work was submitted with by SubmitCtx.  nil for work submitted any other way
+	ctx context.Context
+	// completed once the work has run or been dropped.  nil unless the work was submitted by SubmitResult
+	result *Result
+	// closed just before the work's first attempt runs.  nil unless the work was submitted by SubmitAndWaitStart
+	started chan struct{}
+	// lets the submitter cancel the work until it starts.  nil unless the work was submitted by Submit
+	handle *handle
+	// queued behind the key's work even on a LIFO key: set for the items of a batch, which keep their order, and for
+	// Flush's marker, which must follow everything it waits for
+	fifo bool
+	// never dropped for its key being busy (see WithDropWhileBusy): set for Flush's marker, and for the items of a batch
+	// after the first for their key, which go wherever the first went
+	keep bool
+}
+
+// cancelled returns whether the work's submitter has lost interest in it
+func (e entry[K]) cancelled() bool {
+	return e.ctx != nil && e.ctx.Err() != nil
+}
+
+// KeyedQueue stores the work waiting to run for a single key, for callers who want to replace the built-in queue (see
+// WithQueueFactory), for example with a bounded or persistent one.  Its methods are never called concurrently.
+// Dequeue returns false if the queue is empty
+type KeyedQueue[K comparable] interface {
+	Enqueue(w KeyedWork[K])
+	Dequeue() (KeyedWork[K], bool)
+	Len() int
+}
+
+// Queue is a KeyedQueue for string keys
+type Queue = KeyedQueue[string]
+
+// Ordering is the order in which a key's work runs (see WithKeyOrdering)
+type Ordering int
+
+const (
+	// FIFO runs a key's work in the order it was submitted.  It's the default
+	FIFO Ordering = iota
+	// LIFO runs a key's newest work first, for keys whose newer work supersedes the older
+	LIFO
+)
+
+// keyQueue is what the pool needs from a key's queue.  It's satisfied by the built-in workQueue, and by customQueue for
+// a Queue from WithQueueFactory
+type keyQueue[K comparable] interface {
+	enqueue(e entry[K]) bool
+	pushFront(e entry[K])
+	deque() (entry[K], bool)
+	peek() (entry[K], bool)
+	due() time.Time
+	replaceHead(w KeyedWork[K], swap func(head KeyedWork[K]) bool) bool
+	purge() []entry[K]
+	len() int
+	snapshot() []KeyedWork[K]
+}
+
+// workQueue is the built-in queue.  It honours PriorityWork, DelayedWork, SequencedWork and WithDedupe
+type workQueue[K comparable] struct {
+	// queue of work
+	mtx   *sync.Mutex
+	queue []entry[K]
+	// only queue[head:] is live.  Dequeued slots are cleared so the work they held can be collected
+	head int
+	// whether DedupeWork collapses into identical work queued just ahead of it
+	dedupe bool
+	// whether new work goes ahead of older work of the same priority (see WithKeyOrdering)
+	lifo bool
+	// how long SequencedWork waits for work with lower sequence numbers (see WithReorderWindow).  0 doesn't reorder
+	reorder time.Duration
+	// the sequence number which runs next without waiting, once a SequencedWork has been dequeued
+	nextSeq  int64
+	expected bool
+}
+
+// enqueue inserts the entry behind everything of the same or higher priority, or for a LIFO queue ahead of everything of
+// the same or lower priority, stamping it with the time.  If its work is a duplicate of the newest work of its priority
+// (see WithDedupe), it replaces that entry instead and false is returned
+func (wq *workQueue[K]) enqueue(e entry[K]) bool {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	w := e.work
+	p := priority(w)
+	// the index to insert at, and the index of the newest work of the same priority, if any
+	var i, newest int
+	// a MultiKeyWork keeps its place in the order everything was submitted in (see KeyedMultiKeyWork)
+	if wq.lifo && !isPart(w) && !e.fifo {
+		i = wq.head
+		for i < len(wq.queue) && priority(wq.queue[i].work) > p {
+			i++
+		}
+		newest = i
+	} else {
+		// most work has the default priority, so scan from the back
+		i = len(wq.queue)
+		for i > wq.head && priority(wq.queue[i-1].work) < p {
+			i--
+		}
+		// late SequencedWork goes ahead of what it should have come before
+		if s, ok := wq.sequence(w); ok {
+			for i > wq.head && priority(wq.queue[i-1].work) == p && wq.follows(wq.queue[i-1].work, s) {
+				i--
+			}
+		}
+		newest = i - 1
+	}
+	if wq.dedupe && newest >= wq.head && newest < len(wq.queue) && isDuplicate(wq.queue[newest].work, w) {
+		// the replacement has been waiting as long as the work it replaces, and answers for it
+		e.enqueued = wq.queue[newest].enqueued
+		e.result = e.result.supersede(wq.queue[newest].result)
+		wq.queue[newest].handle.drop()
+		wq.queue[newest] = e
+		return false
+	}
+	e.enqueued = time.Now()
+	wq.queue = append(wq.queue, entry[K]{})
+	copy(wq.queue[i+1:], wq.queue[i:])
+	wq.queue[i] = e
+	return true
+}
+
+// pushFront puts the entry at the head of the queue, regardless of priority
+func (wq *workQueue[K]) pushFront(e entry[K]) {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	if wq.head > 0 {
+		wq.head--
+		wq.queue[wq.head] = e
+		return
+	}
+	wq.queue = append(wq.queue, entry[K]{})
+	copy(wq.queue[1:], wq.queue)
+	wq.queue[0] = e
+}
+
+// deque removes and returns the entry at the head of the queue.  It returns false if the queue is empty
+func (wq *workQueue[K]) deque() (entry[K], bool) {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	if wq.head == len(wq.queue) {
+		return entry[K]{}, false
+	}
+	e := wq.queue[wq.head]
+	wq.queue[wq.head] = entry[K]{}
+	wq.head++
+	if s, ok := wq.sequence(e.work); ok {
+		wq.nextSeq, wq.expected = s+1, true
+	}
+
+	switch {
+	case wq.head == len(wq.queue):
+		// empty: start again from the front of the array, unless a backlog grew it far beyond what's needed
+		if cap(wq.queue) > 4*compactThreshold {
+			wq.queue = make([]entry[K], 0)
+		}
+		wq.queue = wq.queue[:0]
+		wq.head = 0
+	case wq.head >= compactThreshold && wq.head*2 >= len(wq.queue):
+		n := copy(wq.queue, wq.queue[wq.head:])
+		for i := n; i < len(wq.queue); i++ {
+			wq.queue[i] = entry[K]{}
+		}
+		wq.queue = wq.queue[:n]
+		wq.head = 0
+	}
+	return e, true
+}
+
+// peek returns the entry at the head of the queue without removing it.  It returns false if the queue is empty
+func (wq *workQueue[K]) peek() (entry[K], bool) {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	if wq.head == len(wq.queue) {
+		return entry[K]{}, false
+	}
+	return wq.queue[wq.head], true
+}
+
+// due returns when the work at the head of the queue may start: not before a DelayedWork's time, and, while SequencedWork
+// which may not be next waits for the missing work, not before the reorder window is up.  A zero time means it may start
+// now, as does an empty queue
+func (wq *workQueue[K]) due() time.Time {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	if wq.head == len(wq.queue) {
+		return time.Time{}
+	}
+	at := notBefore(wq.queue[wq.head].work)
+	s, ok := wq.sequence(wq.queue[wq.head].work)
+	if !ok || (wq.expected && s <= wq.nextSeq) {
+		return at
+	}
+	// the window runs from when the first work behind the gap arrived
+	var earliest time.Time
+	for _, e := range wq.queue[wq.head:] {
+		if _, ok := wq.sequence(e.work); ok && (earliest.IsZero() || e.enqueued.Before(earliest)) {
+			earliest = e.enqueued
+		}
+	}
+	if held := earliest.Add(wq.reorder); held.After(at) {
+		return held
+	}
+	return at
+}
+
+// sequence returns the work's sequence number, if it's SequencedWork and the queue reorders it
+func (wq *workQueue[K]) sequence(w KeyedWork[K]) (int64, bool) {
+	if wq.reorder <= 0 {
+		return 0, false
+	}
+	return sequence(w)
+}
+
+// follows returns whether the queued work should run after SequencedWork with the given sequence number
+func (wq *workQueue[K]) follows(w KeyedWork[K], s int64) bool {
+	queued, ok := wq.sequence(w)
+	return ok && queued > s
+}
+
+// replaceHead swaps the work at the head of the queue for the given work, which keeps the head's place, and returns true.
+// It returns false if the queue is empty, or if swap, which is called with the head under the queue's lock, returns false
+func (wq *workQueue[K]) replaceHead(w KeyedWork[K], swap func(head KeyedWork[K]) bool) bool {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	if wq.head == len(wq.queue) || !swap(wq.queue[wq.head].work) {
+		return false
+	}
+	// the replaced work can no longer be cancelled, and nor can w, which wasn't submitted with a handle
+	wq.queue[wq.head].handle.drop()
+	wq.queue[wq.head].handle = nil
+	wq.queue[wq.head].work = w
+	return true
+}
+
+// remove takes the entry with the given handle out of the queue, and returns it.  It returns false if the entry isn't
+// queued
+func (wq *workQueue[K]) remove(h *handle) (entry[K], bool) {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	for i := wq.head; i < len(wq.queue); i++ {
+		if wq.queue[i].handle != h {
+			continue
+		}
+		e := wq.queue[i]
+		copy(wq.queue[i:], wq.queue[i+1:])
+		wq.queue[len(wq.queue)-1] = entry[K]{}
+		wq.queue = wq.queue[:len(wq.queue)-1]
+		return e, true
+	}
+	return entry[K]{}, false
+}
+
+// purge removes everything from the queue, returning the removed entries
+func (wq *workQueue[K]) purge() []entry[K] {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	purged := wq.queue[wq.head:]
+	wq.queue = make([]entry[K], 0)
+	wq.head = 0
+	return purged
+}
+
+func (wq *workQueue[K]) len() int {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	return len(wq.queue) - wq.head
+}
+
+// snapshot returns a copy of the queued work, in order
+func (wq *workQueue[K]) snapshot() []KeyedWork[K] {
+	wq.mtx.Lock()
+	defer wq.mtx.Unlock()
+	works := make([]KeyedWork[K], 0, len(wq.queue)-wq.head)
+	for _, e := range wq.queue[wq.head:] {
+		works = append(works, e.work)
+	}
+	return works
+}
+
+// customQueue adapts a Queue to keyQueue.  A Queue holds only work, so anything the pool tracks about queued work is
+// lost: entries come out of it without an enqueue time or a submitter's context.  The exceptions are a Result, a start
+// signal and a cancellation handle, which are kept aside until their work comes back out of the Queue, so that the
+// Queue is handed the work itself.  It also can't be peeked into, so DelayedWork isn't delayed
+type customQueue[K comparable] struct {
+	mtx sync.Mutex
+	q   KeyedQueue[K]
+	// retried work, which runs before anything in the Queue
+	front []entry[K]
+	// the entries of work in the Queue with anything to keep aside, by the work's identity (see identify).  Identical
+	// work is interchangeable, so shares a slot, oldest first
+	aside map[any][]entry[K]
+}
+
+func (cq *customQueue[K]) enqueue(e entry[K]) bool {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	if e.result != nil || e.started != nil || e.handle != nil {
+		if cq.aside == nil {
+			cq.aside = map[any][]entry[K]{}
+		}
+		id := identify(e.work)
+		cq.aside[id] = append(cq.aside[id], entry[K]{result: e.result, started: e.started, handle: e.handle})
+	}
+	cq.q.Enqueue(e.work)
+	return true
+}
+
+// fromQueue makes an entry of work from the Queue, along with anything kept aside for it.  The mutex must be held
+func (cq *customQueue[K]) fromQueue(w KeyedWork[K]) entry[K] {
+	id := identify(w)
+	aside, ok := cq.aside[id]
+	if !ok {
+		return entry[K]{work: w}
+	}
+	e := aside[0]
+	if len(aside) == 1 {
+		delete(cq.aside, id)
+	} else {
+		cq.aside[id] = aside[1:]
+	}
+	e.work = w
+	return e
+}
+
+// identify returns what the work is known by while it's in a Queue: the work itself if it can be compared, or else the
+// address of its value, which is kept as long as the Queue hands back the work it was given
+func identify[K comparable](w KeyedWork[K]) any {
+	if reflect.ValueOf(w).Comparable() {
+		return w
+	}
+	// the data word of the interface, which points at the boxed value
+	return (*[2]unsafe.Pointer)(unsafe.Pointer(&w))[1]
+}
+
+func (cq *customQueue[K]) pushFront(e entry[K]) {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	cq.front = append([]entry[K]{e}, cq.front...)
+}
+
+func (cq *customQueue[K]) deque() (entry[K], bool) {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	if len(cq.front) > 0 {
+		e := cq.front[0]
+		cq.front = cq.front[1:]
+		return e, true
+	}
+	w, ok := cq.q.Dequeue()
+	if !ok {
+		return entry[K]{}, false
+	}
+	return cq.fromQueue(w), true
+}
+
+func (cq *customQueue[K]) peek() (entry[K], bool) {
+	return entry[K]{}, false
+}
+
+func (cq *customQueue[K]) due() time.Time {
+	return time.Time{}
+}
+
+func (cq *customQueue[K]) replaceHead(KeyedWork[K], func(KeyedWork[K]) bool) bool {
+	return false
+}
+
+func (cq *customQueue[K]) purge() []entry[K] {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	purged := cq.front
+	cq.front = nil
+	for {
+		w, ok := cq.q.Dequeue()
+		if !ok {
+			return purged
+		}
+		purged = append(purged, cq.fromQueue(w))
+	}
+}
+
+func (cq *customQueue[K]) len() int {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	return len(cq.front) + cq.q.Len()
+}
+
+// snapshot only sees retried work: the rest is hidden in the Queue
+func (cq *customQueue[K]) snapshot() []KeyedWork[K] {
+	cq.mtx.Lock()
+	defer cq.mtx.Unlock()
+	works := make([]KeyedWork[K], 0, len(cq.front))
+	for _, e := range cq.front {
+		works = append(works, e.work)
+	}
+	return works
+}
@@ -0,0 +1,184 @@
+package workpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue() *workQueue[string] {
+	return &workQueue[string]{queue: make([]entry[string], 0), mtx: &sync.Mutex{}}
+}
+
+func TestWorkQueueFIFO(t *testing.T) {
+	wq := newTestQueue()
+	for i := 0; i < 1000; i++ {
+		wq.enqueue(entry[string]{work: wrk{k: strconv.Itoa(i)}})
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, 1000-i, wq.len())
+		e, ok := wq.peek()
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), e.work.Key())
+		e, ok = wq.deque()
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), e.work.Key())
+	}
+	assert.Equal(t, 0, wq.len())
+	_, ok := wq.peek()
+	assert.False(t, ok)
+	_, ok = wq.deque()
+	assert.False(t, ok)
+}
+
+func TestWorkQueueReleasesDequeued(t *testing.T) {
+	wq := newTestQueue()
+	// keep a small backlog while a lot of work passes through, as a hot key would
+	for i := 0; i < 10; i++ {
+		wq.enqueue(entry[string]{work: wrk{k: strconv.Itoa(i)}})
+	}
+	for i := 10; i < 100000; i++ {
+		wq.enqueue(entry[string]{work: wrk{k: strconv.Itoa(i)}})
+		e, _ := wq.deque()
+		assert.Equal(t, strconv.Itoa(i-10), e.work.Key())
+	}
+	assert.Equal(t, 10, wq.len())
+	assert.LessOrEqual(t, cap(wq.queue), 4*compactThreshold)
+	for i := 0; i < wq.head; i++ {
+		assert.Nil(t, wq.queue[i].work)
+	}
+}
+
+// BenchmarkHotKey reports the heap still in use after a single key has processed b.N items.  It should stay flat as
+// b.N grows
+func BenchmarkHotKey(b *testing.B) {
+	b.ReportAllocs()
+	wg := sync.WaitGroup{}
+	wg.Add(b.N)
+	sut := New(WithIdleTimeout(time.Minute))
+	for i := 0; i < b.N; i++ {
+		sut.Submit(wrk{k: "key", d: wg.Done})
+	}
+	wg.Wait()
+
+	b.StopTimer()
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	b.ReportMetric(float64(m.HeapInuse), "heap-bytes")
+	sut.Close()
+}
+
+// stackQueue is a Queue which runs the latest work first
+type stackQueue struct {
+	works []Work
+}
+
+func (s *stackQueue) Enqueue(w Work) {
+	s.works = append(s.works, w)
+}
+
+func (s *stackQueue) Dequeue() (Work, bool) {
+	if len(s.works) == 0 {
+		return nil, false
+	}
+	w := s.works[len(s.works)-1]
+	s.works = s.works[:len(s.works)-1]
+	return w, true
+}
+
+func (s *stackQueue) Len() int {
+	return len(s.works)
+}
+
+// fifoQueue is a Queue which behaves like the built-in queue, for plain work
+type fifoQueue struct {
+	stackQueue
+}
+
+func (f *fifoQueue) Dequeue() (Work, bool) {
+	if len(f.works) == 0 {
+		return nil, false
+	}
+	w := f.works[0]
+	f.works = f.works[1:]
+	return w, true
+}
+
+func TestQueueFactory(t *testing.T) {
+	var mtx sync.Mutex
+	var created []string
+	sut := New(WithQueueFactory(func(key string) Queue {
+		mtx.Lock()
+		defer mtx.Unlock()
+		created = append(created, key)
+		if key == "stack" {
+			return &stackQueue{}
+		}
+		return &fifoQueue{}
+	}))
+
+	// the ordering tests hold against a FIFO Queue
+	wg := sync.WaitGroup{}
+	wg.Add(7 * 2)
+	s := newSystem()
+	w1, expected1 := s.newWorkForKey(&wg, "key1")
+	w2, expected2 := s.newWorkForKey(&wg, "key2")
+	sut.SubmitBatch(append(w1, w2...))
+	wg.Wait()
+	assert.Equal(t, expected1, s.getValue("key1"))
+	assert.Equal(t, expected2, s.getValue("key2"))
+
+	// while the Queue decides the order
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []int
+	sut.Submit(wrk{k: "stack", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	sut.Submit(wrk{k: "stack", d: func() { ran = append(ran, -1) }})
+	assert.Equal(t, 1, sut.PurgeKey("stack"))
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "stack", d: func() { ran = append(ran, i) }})
+	}
+	assert.Equal(t, 3, sut.KeyQueueLen("stack"))
+	close(block)
+	sut.Wait()
+
+	assert.Equal(t, []int{2, 1, 0}, ran)
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.ElementsMatch(t, []string{"key1", "key2", "stack"}, created)
+}
+
+func TestQueueFactoryGetsSubmittedWork(t *testing.T) {
+	q := &fifoQueue{}
+	sut := New(WithQueueFactory(func(string) Queue { return q }))
+	sut.Pause("key")
+	var ran []string
+	cancel := sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "cancelled") }})
+	r := sut.SubmitResult(wrk{k: "key", d: func() { ran = append(ran, "result") }})
+	// comparable work, which is told apart by its value rather than its address
+	rp := sut.SubmitResult(&wrk{k: "key", d: func() { ran = append(ran, "pointer") }})
+
+	// the Queue holds the work as it was submitted, not wrapped
+	if assert.Len(t, q.works, 3) {
+		assert.IsType(t, wrk{}, q.works[0])
+		assert.IsType(t, wrk{}, q.works[1])
+		assert.IsType(t, &wrk{}, q.works[2])
+	}
+	// while cancellation and Results still follow it
+	assert.True(t, cancel())
+	sut.Resume("key")
+	r.Wait()
+	rp.Wait()
+	assert.NoError(t, r.Err())
+	assert.NoError(t, rp.Err())
+	assert.Equal(t, []string{"result", "pointer"}, ran)
+	sut.Close()
+}
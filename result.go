@@ -0,0 +1,139 @@
+package workpool
+
+import "sync"
+
+// Result tracks a single submitted item, for callers who want to await that item rather than the whole pool.  It's
+// returned by SubmitResult and SubmitErrResult, and is completed once the item has finished running, or once it's
+// dropped without running
+type Result struct {
+	once sync.Once
+	done chan struct{}
+	// set before done is closed
+	err error
+	// results of earlier work collapsed into this work by WithDedupe, which complete along with it
+	merged []*Result
+	// called once the Result has completed.  nil if nothing needs to know
+	onComplete func()
+}
+
+func newResult() *Result {
+	return &Result{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed once the item has completed
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait blocks until the item has completed
+func (r *Result) Wait() {
+	<-r.done
+}
+
+// Err returns why the item failed, or nil if it ran successfully.  That's the error returned by an ErrWork's final
+// attempt, an error describing a panic, or why the item was dropped without running: ErrWorkDropped, ErrWorkExpired,
+// or the error of the context it was submitted with by SubmitCtx.  Err returns nil until the item has completed
+func (r *Result) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// complete records the item's outcome, along with that of any work it superseded.  It's a no-op for a nil Result, so
+// that work submitted without one needn't be checked for it
+func (r *Result) complete(err error) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+		for _, m := range r.merged {
+			m.complete(err)
+		}
+		if r.onComplete != nil {
+			r.onComplete()
+		}
+	})
+}
+
+// supersede returns the Result for work which replaces earlier work (see WithDedupe), such that the earlier work's
+// Result completes along with it.  Either Result may be nil
+func (r *Result) supersede(earlier *Result) *Result {
+	if r == nil {
+		return earlier
+	}
+	if earlier != nil {
+		r.merged = append(r.merged, earlier)
+	}
+	return r
+}
+
+// SubmitResult submits the given work like Submit, and returns a Result which completes once the work has run.  The
+// Result is completed once the work returns, before the key moves on to its next item, so Results for the same key
+// complete in the order their work runs.  Work which panics completes with an error describing the panic.  Work dropped
+// by WithDedupe completes along with the work that superseded it.
+// Identical submissions are coalesced: an IdempotentWork submitted while one with the same key and IdempotencyKey which
+// was submitted by SubmitResult is queued or running isn't queued itself.  Its caller is handed the Result of the
+// identical work instead, so that every caller waits for the single execution, singleflight style
+func (wp *KeyedWorkpool[K]) SubmitResult(w KeyedWork[K]) *Result {
+	r := newResult()
+	wp.awaitGate(w)
+	wp.reserve(w)
+	defer wp.drainSync()
+	defer wp.aboveWatermark(w)
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	if err := wp.admits(w); err != nil {
+		wp.unreserve(w)
+		panic(err)
+	}
+	if shared, ok := wp.coalesce(w, r); ok {
+		wp.unreserve(w)
+		return shared
+	}
+	wp.enqueueLocked(entry[K]{work: w, result: r})
+	return r
+}
+
+// SubmitErrResult submits the given fallible work like SubmitErr, and returns a Result whose Err is the work's final
+// error, as SubmitResult does
+func (wp *KeyedWorkpool[K]) SubmitErrResult(w KeyedErrWork[K]) *Result {
+	return wp.SubmitResult(errWork[K]{KeyedErrWork: w})
+}
+
+// SubmitAndWaitStart submits the given work like Submit, then blocks until the work has been dequeued and is about to
+// run: it holds its key, and its slot under any concurrency limit (see WithMaxConcurrency).  It returns nil once the work
+// has started, which may be before, during or after its Do.  If the work is dropped without running, SubmitAndWaitStart
+// returns why, as Result.Err does.  Work which never reaches the head of its queue, such as work for a paused key,
+// blocks SubmitAndWaitStart until it does
+func (wp *KeyedWorkpool[K]) SubmitAndWaitStart(w KeyedWork[K]) error {
+	r := newResult()
+	started := make(chan struct{})
+	func() {
+		wp.awaitGate(w)
+		wp.reserve(w)
+		defer wp.drainSync()
+		defer wp.aboveWatermark(w)
+		wp.submitMtx.Lock()
+		defer wp.submitMtx.Unlock()
+		wp.submitLocked(entry[K]{work: w, result: r, started: started})
+	}()
+
+	select {
+	case <-started:
+		return nil
+	case <-r.Done():
+	}
+	// work which ran quickly completes its Result too
+	select {
+	case <-started:
+		return nil
+	default:
+		return r.Err()
+	}
+}
@@ -0,0 +1,139 @@
+package workpool
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitResult(t *testing.T) {
+	sut := New(WithPanicHandler(func(Work, interface{}, []byte) {}))
+	block := make(chan struct{})
+	first := sut.SubmitResult(wrk{k: "key", d: func() { <-block }})
+	second := sut.SubmitResult(wrk{k: "key", d: func() {}})
+
+	select {
+	case <-first.Done():
+		t.Fatal("result completed before its work ran")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(block)
+	second.Wait()
+	// the first completed before the key moved on to the second
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("results completed out of order")
+	}
+	first.Wait()
+	assert.NoError(t, first.Err())
+	assert.NoError(t, second.Err())
+
+	boom := errors.New("boom")
+	failed := sut.SubmitErrResult(errWrk{k: "key", d: func() error { return boom }})
+	panicked := sut.SubmitResult(wrk{k: "key", d: func() { panic("oops") }})
+	panicked.Wait()
+	assert.ErrorIs(t, failed.Err(), boom)
+	assert.EqualError(t, panicked.Err(), "panic: oops")
+}
+
+func TestResultDropped(t *testing.T) {
+	sut := New(WithDedupe())
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+
+	purged := sut.SubmitResult(wrk{k: "key", d: func() {}})
+	assert.Equal(t, 1, sut.PurgeKey("key"))
+	assert.ErrorIs(t, purged.Err(), ErrWorkDropped)
+
+	// collapsed work completes along with the work which replaced it
+	var ran []string
+	superseded := sut.SubmitResult(dedupeWrk{wrk: wrk{k: "key", d: func() { ran = append(ran, "superseded") }}, id: "id"})
+	latest := sut.SubmitResult(dedupeWrk{wrk: wrk{k: "key", d: func() { ran = append(ran, "latest") }}, id: "id"})
+	close(block)
+	superseded.Wait()
+	latest.Wait()
+	assert.Equal(t, []string{"latest"}, ran)
+	sut.Wait()
+}
+
+func TestSubmitAndWaitStart(t *testing.T) {
+	sut := New()
+	first := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-first }})
+
+	second := make(chan struct{})
+	var completed int32
+	returned := make(chan error)
+	go func() {
+		returned <- sut.SubmitAndWaitStart(wrk{k: "key", d: func() {
+			<-second
+			atomic.StoreInt32(&completed, 1)
+		}})
+	}()
+	// queued behind the first item, which holds the key
+	assert.Eventually(t, func() bool { return sut.QueueLen() == 2 }, time.Second, time.Millisecond)
+	select {
+	case <-returned:
+		t.Fatal("returned before the work started")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(first)
+	assert.NoError(t, <-returned)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&completed))
+	close(second)
+	sut.Wait()
+
+	// dropped work never starts
+	block := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+	go func() {
+		returned <- sut.SubmitAndWaitStart(wrk{k: "key", d: func() { t.Error("dropped work ran") }})
+	}()
+	assert.Eventually(t, func() bool { return sut.QueueLen() == 2 }, time.Second, time.Millisecond)
+	sut.Close()
+	close(block)
+	assert.ErrorIs(t, <-returned, ErrWorkDropped)
+}
+
+func TestSubmitResultCoalesces(t *testing.T) {
+	sut := New()
+	var calls int32
+	block := make(chan struct{})
+	op := idempotentWrk{wrk: wrk{k: "key", d: func() {
+		atomic.AddInt32(&calls, 1)
+		<-block
+	}}, id: "op"}
+
+	results := make(chan *Result, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- sut.SubmitResult(op)
+		}()
+	}
+	var shared []*Result
+	for i := 0; i < 3; i++ {
+		shared = append(shared, <-results)
+	}
+	close(block)
+	for _, r := range shared {
+		r.Wait()
+		assert.NoError(t, r.Err())
+		assert.Same(t, shared[0], r)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// once it has completed, the operation runs afresh
+	again := sut.SubmitResult(op)
+	assert.NotSame(t, shared[0], again)
+	again.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,48 @@
+package workpool
+
+import (
+	"errors"
+)
+
+// errYielded is returned by do when a ResumableWork yields.  It's never seen outside the workpool
+var errYielded = errors.New("workpool: work yielded")
+
+// KeyedResumableWork is a variant of KeyedWork for long-running work which yields to the rest of its key's queue part
+// way through, so that a big job doesn't hold up the key's other work until it's done.  It is submitted via
+// SubmitResumable
+type KeyedResumableWork[K comparable] interface {
+	// Key has the same meaning as Work's Key
+	Key() K
+
+	// Do performs a step of the work, returning true once the work is done.  If it returns false, the work goes to the
+	// back of its key's queue, and Do is called again once the work queued ahead of it has run
+	Do() (done bool)
+}
+
+// ResumableWork is a KeyedResumableWork for string keys
+type ResumableWork = KeyedResumableWork[string]
+
+// resumableWork adapts ResumableWork to the Work interface.  The manager recognizes it and requeues it when it yields
+type resumableWork[K comparable] struct {
+	KeyedResumableWork[K]
+}
+
+func (r resumableWork[K]) Do() {
+	_ = r.KeyedResumableWork.Do()
+}
+
+// SubmitResumable submits the given resumable work.  It behaves like Submit, except that each time the work yields, it's
+// queued again behind the work for its key which has been submitted meanwhile, as if it had just been submitted.  The
+// work only counts as finished, for example by WaitKey and Wait, once its Do returns true.  The work's key is
+// still held while each step runs, so the key's work never runs concurrently.  Note that a panic handler is given the
+// work wrapped in an adapter to Work
+func (wp *KeyedWorkpool[K]) SubmitResumable(w KeyedResumableWork[K]) {
+	wp.Submit(resumableWork[K]{KeyedResumableWork: w})
+}
+
+// requeue puts work which has yielded at the back of its queue.  The key must still be locked, so that the work can't
+// run again before the work ahead of it
+func (wp *KeyedWorkpool[K]) requeue(wq keyQueue[K], e entry[K]) {
+	wp.debug("workpool: work yielded", e.work.Key())
+	wq.enqueue(e)
+}
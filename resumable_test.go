@@ -0,0 +1,50 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+type resumableWrk struct {
+	k string
+	d func() bool
+}
+
+func (w resumableWrk) Key() string {
+	return w.k
+}
+
+func (w resumableWrk) Do() bool {
+	return w.d()
+}
+
+func TestSubmitResumable(t *testing.T) {
+	sut := New()
+	var ran []string
+	steps := 0
+	sut.SubmitResumable(resumableWrk{k: "key", d: func() bool {
+		steps++
+		ran = append(ran, "step"+strconv.Itoa(steps))
+		if steps == 3 {
+			return true
+		}
+		// arrives while the big job is running, so runs before its next step
+		name := "item" + strconv.Itoa(steps)
+		sut.Submit(wrk{k: "key", d: func() { ran = append(ran, name) }})
+		return false
+	}})
+	assert.NoError(t, sut.WaitKey(context.Background(), "key"))
+	assert.Equal(t, []string{"step1", "item1", "step2", "item2", "step3"}, ran)
+
+	// the work is only finished once it's done
+	r := sut.SubmitResult(resumableWork[string]{KeyedResumableWork: resumableWrk{k: "key", d: func() bool {
+		steps++
+		return steps == 5
+	}}})
+	r.Wait()
+	assert.NoError(t, r.Err())
+	assert.Equal(t, 5, steps)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
@@ -0,0 +1,125 @@
+package workpool
+
+import (
+	"golang.org/x/time/rate"
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+// shard runs the work of every key hashed to it on a single goroutine, in place of a manager per key (see WithShards).
+// Keys with work take turns, an item at a time, so a key's work runs in order while colliding keys share the goroutine
+type shard[K comparable] struct {
+	mtx sync.Mutex
+	// keys with work, in the order they'll next be served.  Each active key is in here exactly once
+	keys []K
+	// whether the shard's goroutine is running.  It exits once no key has work
+	running bool
+	// the rate limiter of each active key which is rate limited.  Only used by the shard's goroutine
+	limiters map[K]*rate.Limiter
+}
+
+// shardOf returns the shard which serves the key.  The hash is stable, so a key always lands on the same shard
+func (wp *KeyedWorkpool[K]) shardOf(key K) *shard[K] {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(keyString(key)))
+	return wp.shards[h.Sum32()%uint32(len(wp.shards))]
+}
+
+// serve queues the key on its shard, and starts the shard's goroutine if it's stopped.  The key must be set up
+func (s *shard[K]) serve(wp *KeyedWorkpool[K], key K) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = append(s.keys, key)
+	if !s.running {
+		s.running = true
+		go s.run(wp)
+	}
+}
+
+// run serves the shard's keys until none has work left
+func (s *shard[K]) run(wp *KeyedWorkpool[K]) {
+	if wp.cfg.threadAffinity {
+		// never unlocked, like a manager's thread (see WithThreadAffinity)
+		runtime.LockOSThread()
+	}
+	for {
+		s.mtx.Lock()
+		if len(s.keys) == 0 {
+			s.running = false
+			s.mtx.Unlock()
+			return
+		}
+		key := s.keys[0]
+		s.keys = s.keys[1:]
+		s.mtx.Unlock()
+
+		wp.runShardItem(s, key)
+		if !wp.retireShardKey(s, key) {
+			// the key goes to the back of the line, behind the shard's other keys
+			s.mtx.Lock()
+			s.keys = append(s.keys, key)
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// runShardItem runs the key's next item on the shard's goroutine, as its manager would.  Whatever the key waits for
+// holds up the whole shard
+func (wp *KeyedWorkpool[K]) runShardItem(s *shard[K], key K) {
+	notif, _ := wp.notif.Load(key)
+	notif.(sync.Locker).Lock()
+	p, _ := wp.pool.Load(key)
+	wq := p.(keyQueue[K])
+	pend, _ := wp.pending.Load(key)
+	pending := pend.(*int64)
+	wp.awaitResume(key)
+	// SequencedWork filling a gap (see WithReorderWindow) arrives with a signal, so the shard needn't wait out the window
+	ready, _ := wp.ready.Load(key)
+	wp.awaitHead(wq, ready.(chan struct{}))
+	if wp.hooks.keyRateLimit != nil {
+		limiter, ok := s.limiters[key]
+		if !ok {
+			limiter = rate.NewLimiter(wp.hooks.keyRateLimit(key), 1)
+			s.limiters[key] = limiter
+		}
+		// this only fails if the pool is closed, which is checked below
+		_ = limiter.Wait(wp.ctx)
+	}
+	e, ok := wq.deque()
+	if !ok {
+		// the queue was purged
+		notif.(sync.Locker).Unlock()
+		return
+	}
+	wp.belowWatermark(key, wq)
+	span := wp.startSpan(key, e, wq)
+	if err := wp.dropReason(key, e); err != nil {
+		endSpan(span, err)
+		e.result.complete(err)
+		wp.finish(pending, e.work)
+		notif.(sync.Locker).Unlock()
+		return
+	}
+	wp.run(key, wq, notif.(sync.Locker), pending, e, span)
+}
+
+// retireShardKey retires the key if it has no work left, as an idle manager would, and returns whether it did
+func (wp *KeyedWorkpool[K]) retireShardKey(s *shard[K], key K) bool {
+	p, _ := wp.pool.Load(key)
+	wq := p.(keyQueue[K])
+	if wq.len() > 0 {
+		// checked again under the submit mutex if it looks empty
+		return false
+	}
+	notif, _ := wp.notif.Load(key)
+	notif.(sync.Locker).Lock()
+	retired := wp.retireKey(key, wq, notif.(sync.Locker))
+	notif.(sync.Locker).Unlock()
+	if !retired {
+		return false
+	}
+	delete(s.limiters, key)
+	wp.exitManager(key)
+	return true
+}
@@ -0,0 +1,46 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	sut := New(WithShards(4))
+	var mtx sync.Mutex
+	ran := map[string][]int{}
+	var running, maxRunning int32
+	var onShard int32
+	for i := 0; i < 5; i++ {
+		for k := 0; k < 1000; k++ {
+			key, seq := strconv.Itoa(k), i
+			sut.Submit(wrk{k: key, d: func() {
+				r := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				// every item runs on its shard's goroutine, rather than on a goroutine of its own or its key's
+				if calledBy("(*shard[...]).run") {
+					atomic.AddInt32(&onShard, 1)
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				ran[key] = append(ran[key], seq)
+				maxRunning = max(maxRunning, r)
+			}})
+		}
+	}
+	sut.Wait()
+
+	assert.Equal(t, int32(5000), atomic.LoadInt32(&onShard))
+	assert.LessOrEqual(t, maxRunning, int32(4))
+	assert.Len(t, ran, 1000)
+	for key, order := range ran {
+		assert.Equal(t, []int{0, 1, 2, 3, 4}, order, key)
+	}
+	assert.Equal(t, 0, sut.NumManagers())
+	assert.Empty(t, sut.Keys())
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
@@ -0,0 +1,68 @@
+package workpool
+
+import "sync"
+
+// drainSync runs the work queued so far on the calling goroutine, in the order it was submitted across all keys (see
+// WithSynchronous).  Only one goroutine drains at a time: if another is already draining, such as when work submits
+// more work, that one runs the new work once it's through what came before, so drainSync returns at once
+func (wp *KeyedWorkpool[K]) drainSync() {
+	if !wp.cfg.synchronous {
+		return
+	}
+	wp.syncMtx.Lock()
+	defer wp.syncMtx.Unlock()
+	if wp.syncDraining {
+		return
+	}
+	wp.syncDraining = true
+	defer func() { wp.syncDraining = false }()
+	for len(wp.syncOrder) > 0 {
+		key := wp.syncOrder[0]
+		wp.syncOrder = wp.syncOrder[1:]
+		wp.syncMtx.Unlock()
+		retried := wp.runSync(key)
+		wp.syncMtx.Lock()
+		if retried {
+			// the key's failed item is back at the head of its queue, and goes again before anything else
+			wp.syncOrder = append([]K{key}, wp.syncOrder...)
+		}
+	}
+}
+
+// runSync runs the next item of the key in place of its manager, and returns whether the item was put back to be
+// retried (see WithRetry).  Resumable work which yields is queued again behind everything else
+func (wp *KeyedWorkpool[K]) runSync(key K) bool {
+	notif, _ := wp.notif.Load(key)
+	notif.(sync.Locker).Lock()
+	p, _ := wp.pool.Load(key)
+	wq := p.(keyQueue[K])
+	pend, _ := wp.pending.Load(key)
+	pending := pend.(*int64)
+	// a DelayedWork or a retry is waited for rather than skipped, so that later work can't overtake it
+	wp.awaitHead(wq, nil)
+	e, ok := wq.deque()
+	if !ok {
+		// the work was purged
+		notif.(sync.Locker).Unlock()
+		return false
+	}
+	wp.belowWatermark(key, wq)
+	span := wp.startSpan(key, e, wq)
+	if err := wp.dropReason(key, e); err != nil {
+		endSpan(span, err)
+		e.result.complete(err)
+		wp.finish(pending, e.work)
+		notif.(sync.Locker).Unlock()
+		return false
+	}
+	if !wp.run(key, wq, notif.(sync.Locker), pending, e, span) {
+		return false
+	}
+	if _, ok := e.work.(resumableWork[K]); ok {
+		wp.syncMtx.Lock()
+		wp.syncOrder = append(wp.syncOrder, key)
+		wp.syncMtx.Unlock()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package workpool
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultThroughputWindow is how far back throughput looks by default (see WithThroughputWindow)
+const defaultThroughputWindow = 10 * time.Second
+
+// meter tracks a rate of events as an exponentially weighted moving average.  The average decays continuously with
+// time rather than on a ticker, so an idle meter costs nothing: each event decays the rate for the time since the last
+// event, then adds its own weight
+type meter struct {
+	mtx sync.Mutex
+	// events per second, as of last
+	rate float64
+	last time.Time
+}
+
+// mark records an event at the given time
+func (m *meter) mark(now time.Time, window time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rate = m.decayed(now, window) + 1/window.Seconds()
+	m.last = now
+}
+
+// read returns the rate of events per second as of the given time
+func (m *meter) read(now time.Time, window time.Duration) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.decayed(now, window)
+}
+
+// reset forgets every event
+func (m *meter) reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rate = 0
+	m.last = time.Time{}
+}
+
+// decayed returns the rate decayed for the time since the last event.  The mutex must be held
+func (m *meter) decayed(now time.Time, window time.Duration) float64 {
+	if m.last.IsZero() {
+		return 0
+	}
+	return m.rate * math.Exp(-now.Sub(m.last).Seconds()/window.Seconds())
+}
+
+// markCompleted records that an item for the key has finished, for the throughput gauges
+func (wp *KeyedWorkpool[K]) markCompleted(key K, now time.Time) {
+	wp.throughput.mark(now, wp.cfg.meterWindow)
+	if !wp.cfg.keyThroughput {
+		return
+	}
+	m, _ := wp.keyRates.LoadOrStore(key, &meter{})
+	m.(*meter).mark(now, wp.cfg.meterWindow)
+}
+
+// KeyThroughput returns how many of the key's items have finished per second, averaged over the window given to
+// WithThroughputWindow.  It returns 0 unless the workpool was created with WithKeyThroughput, and for a key which isn't
+// tracked, since a key's average is forgotten along with the key once it goes idle
+func (wp *KeyedWorkpool[K]) KeyThroughput(key K) float64 {
+	m, ok := wp.keyRates.Load(key)
+	if !ok {
+		return 0
+	}
+	return m.(*meter).read(time.Now(), wp.cfg.meterWindow)
+}
@@ -0,0 +1,35 @@
+package workpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestThroughput(t *testing.T) {
+	sut := New(WithThroughputWindow(100*time.Millisecond), WithKeyThroughput())
+	assert.Zero(t, sut.Stats().Throughput)
+	assert.Zero(t, sut.KeyThroughput("key"))
+
+	// a steady 200 items a second, for several windows
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; i < 100; i++ {
+		<-ticker.C
+		sut.Submit(wrk{k: "key", d: func() {}})
+	}
+	assert.InDelta(t, 200, sut.Stats().Throughput, 100)
+	assert.InDelta(t, 200, sut.KeyThroughput("key"), 100)
+	assert.Zero(t, sut.KeyThroughput("other"))
+
+	// the average decays once work stops
+	time.Sleep(500 * time.Millisecond)
+	assert.Less(t, sut.Stats().Throughput, 10.0)
+
+	// per-key tracking is opt in
+	sut = New()
+	sut.Submit(wrk{k: "key", d: func() {}})
+	sut.Wait()
+	assert.Greater(t, sut.Stats().Throughput, 0.0)
+	assert.Zero(t, sut.KeyThroughput("key"))
+}
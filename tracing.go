@@ -0,0 +1,57 @@
+package workpool
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanName is the name of the span created for each item when tracing is enabled
+const spanName = "workpool.Do"
+
+// TracedWork is Work which carries the context it was submitted from.  When a tracer is configured (see WithTracer),
+// the work's span is created as a child of the span in that context
+type TracedWork interface {
+	Work
+
+	// TraceContext returns the context holding the parent span
+	TraceContext() context.Context
+}
+
+// startSpan starts the span for a just-dequeued entry, backdated to when the entry was submitted so that it covers the
+// time spent queueing.  It returns nil if tracing is disabled
+func (wp *KeyedWorkpool[K]) startSpan(key K, e entry[K], wq keyQueue[K]) trace.Span {
+	if wp.cfg.tracer == nil {
+		return nil
+	}
+	parent := context.Background()
+	if tw, ok := e.work.(interface{ TraceContext() context.Context }); ok {
+		parent = tw.TraceContext()
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(
+			attribute.String("workpool.key", keyString(key)),
+			attribute.Int("workpool.queue_depth", wq.len()),
+		),
+	}
+	// work from a custom Queue has no enqueue time, so its span starts now
+	if !e.enqueued.IsZero() {
+		opts = append(opts, trace.WithTimestamp(e.enqueued))
+	}
+	_, span := wp.cfg.tracer.Start(parent, spanName, opts...)
+	span.AddEvent("dequeued")
+	return span
+}
+
+// endSpan ends the span, if there is one, recording any error
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,66 @@
+package workpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+type tracedWrk struct {
+	wrk
+	ctx context.Context
+}
+
+func (w tracedWrk) TraceContext() context.Context {
+	return w.ctx
+}
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+	sut := New(WithTracer(tracer), WithPanicHandler(func(Work, interface{}, []byte) {}))
+
+	parentCtx, parent := tracer.Start(context.Background(), "parent")
+	block := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+	sut.Submit(tracedWrk{wrk: wrk{k: "key", d: func() {}}, ctx: parentCtx})
+	sut.Submit(wrk{k: "key", d: func() { panic("boom") }})
+	time.Sleep(10 * time.Millisecond)
+	close(block)
+	sut.Wait()
+	parent.End()
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == spanName {
+			spans = append(spans, span)
+		}
+	}
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	for _, span := range spans {
+		assert.Contains(t, span.Attributes(), attribute.String("workpool.key", "key"))
+	}
+	// the second item was queued behind the first, so its span covers the wait
+	traced := spans[1]
+	assert.Equal(t, parent.SpanContext().SpanID(), traced.Parent().SpanID())
+	assert.GreaterOrEqual(t, traced.EndTime().Sub(traced.StartTime()), 10*time.Millisecond)
+	assert.Contains(t, traced.Attributes(), attribute.Int("workpool.queue_depth", 1))
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+}
+
+func TestNoTracerDoesNotAllocate(t *testing.T) {
+	sut := New()
+	wq := &workQueue[string]{}
+	allocs := testing.AllocsPerRun(100, func() {
+		endSpan(sut.startSpan("key", entry[string]{}, wq), nil)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
@@ -0,0 +1,37 @@
+package workpool
+
+// unorderedLock stands in for a key's mutex when the key is unordered (see WithUnorderedKey and
+// WithPerKeyConcurrency).  It lets up to its capacity of holders in at once, so the key's manager can start that many
+// items before it has to wait for one to finish
+type unorderedLock struct {
+	held chan struct{}
+}
+
+func newUnorderedLock(parallelism int) *unorderedLock {
+	return &unorderedLock{held: make(chan struct{}, parallelism)}
+}
+
+func (l *unorderedLock) Lock() {
+	l.held <- struct{}{}
+}
+
+func (l *unorderedLock) Unlock() {
+	<-l.held
+}
+
+// holders returns how many holders are in
+func (l *unorderedLock) holders() int {
+	return len(l.held)
+}
+
+// parallelism returns how many of the key's items may run at once, and whether the key is unordered because of it.  A
+// key given to WithUnorderedKey takes its own parallelism over WithPerKeyConcurrency's
+func (wp *KeyedWorkpool[K]) parallelism(key K) (int, bool) {
+	if n, ok := wp.hooks.unordered[key]; ok {
+		return n, true
+	}
+	if wp.cfg.perKeyConcurrency > 1 {
+		return wp.cfg.perKeyConcurrency, true
+	}
+	return 1, false
+}
@@ -0,0 +1,40 @@
+package workpool
+
+import "sync/atomic"
+
+// aboveWatermark calls the high watermark callback if the work's key has just queued more than the watermark (see
+// WithQueueHighWatermark).  Submitters call it once they've released the submit mutex, so that the callback may submit
+func (wp *KeyedWorkpool[K]) aboveWatermark(w KeyedWork[K]) {
+	if wp.hooks.highWatermark == nil || isNil(w) {
+		return
+	}
+	key := w.Key()
+	depth := wp.KeyQueueLen(key)
+	if depth <= wp.cfg.highWatermark {
+		return
+	}
+	above, _ := wp.watermarks.LoadOrStore(key, new(uint32))
+	if atomic.CompareAndSwapUint32(above.(*uint32), 0, 1) {
+		wp.hooks.highWatermark(key, depth)
+	}
+}
+
+// belowWatermark calls the high watermark callback once a key which crossed the watermark has recovered to half of it.
+// The gap between the two stops a queue hovering around the watermark from calling back on every item.  The key's
+// manager calls it as its queue shrinks
+func (wp *KeyedWorkpool[K]) belowWatermark(key K, wq keyQueue[K]) {
+	if wp.hooks.highWatermark == nil {
+		return
+	}
+	above, ok := wp.watermarks.Load(key)
+	if !ok {
+		return
+	}
+	depth := wq.len()
+	if depth > wp.cfg.highWatermark/2 {
+		return
+	}
+	if atomic.CompareAndSwapUint32(above.(*uint32), 1, 0) {
+		wp.hooks.highWatermark(key, depth)
+	}
+}
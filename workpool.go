@@ -1,167 +1,2132 @@
 // Package workpool implements a workpool synchronized on a work item's Key.
-//in the course of the workpool's life, two times the number of unique keys can be created
-//one goroutine per key max for parallel processing
-//another goroutine per key max for work queue management
+//in the course of the workpool's life, one goroutine per unique key can be created
+//each key's management goroutine runs the key's work itself, one item at a time, so keys are processed in parallel
+//an unordered key, or a workpool with completion callbacks, runs each item in a goroutine of its own instead
+//once a key's work is done and its management goroutine dies, all state for the key is released
 package workpool
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"maps"
 	"math"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// Work is the interface for callers to use this library.  Each unit of work (such as an event) must implement the Work interface
-type Work interface {
+// ErrPoolClosed is the value Submit panics with when work is submitted after Shutdown or Close
+var ErrPoolClosed = errors.New("workpool: pool is shut down")
+
+// ErrDraining is the value Submit panics with when work is submitted for a new key after Drain
+var ErrDraining = errors.New("workpool: pool is draining")
+
+// ErrBatchTooLarge is the value SubmitBatch panics with when the batch could never fit under WithMaxTotalQueue or
+// WithMaxQueueBytes
+var ErrBatchTooLarge = errors.New("workpool: batch exceeds the maximum total queue")
+
+// ErrWorkTimeout is delivered on the Errors channel for work which runs for longer than allowed by WithWorkTimeout
+var ErrWorkTimeout = errors.New("workpool: work exceeded its timeout")
+
+// ErrWorkExpired is delivered on the Errors channel, and is the error of any Result, for work which was dropped after
+// queueing for longer than allowed by WithQueueTTL
+var ErrWorkExpired = errors.New("workpool: work expired in the queue")
+
+// ErrCircuitOpen is delivered on the Errors channel, and is the error of any Result, for work which was failed fast
+// because its key's circuit breaker was open (see WithCircuitBreaker)
+var ErrCircuitOpen = errors.New("workpool: circuit breaker is open")
+
+// ErrSelfDeadlock is returned by WaitKey when it's called from work for the same key, which would wait forever on itself
+var ErrSelfDeadlock = errors.New("workpool: work is waiting on its own key")
+
+// ErrNilWork is the value Submit panics with when it's given nil work
+var ErrNilWork = errors.New("workpool: work is nil")
+
+// ErrEmptyKey is the value Submit panics with when it's given work whose key is the empty string.  An empty key is
+// almost always a bug, such as an unset field, which would otherwise serialize unrelated work behind a single key
+var ErrEmptyKey = errors.New("workpool: work has an empty key")
+
+// ErrQueueFull is returned by SubmitOrErr when the work's key already has as many items queued as WithMaxQueueDepth
+// allows, or the workpool is full (see WithMaxTotalQueue)
+var ErrQueueFull = errors.New("workpool: queue is full")
+
+// ErrPaused is returned by SubmitOrErr when the work's key, or the whole workpool, is paused
+var ErrPaused = errors.New("workpool: key is paused")
+
+// ErrGateClosed is returned by SubmitOrErr when the gate given to WithSubmitGate is closed for the work's key
+var ErrGateClosed = errors.New("workpool: submit gate is closed")
+
+// ErrWorkDropped is the error of a Result whose work was dropped without running, because the pool was closed, the work
+// was purged by PurgeKey, or identical IdempotentWork was running
+var ErrWorkDropped = errors.New("workpool: work dropped")
+
+// ShutdownError is returned by Shutdown when its context expires before all submitted work has run
+type ShutdownError struct {
+	// Remaining is the number of submitted items which had not yet finished when the context expired
+	Remaining uint64
+	// Err is the context's error
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("workpool: shutdown interrupted with %d items left: %v", e.Remaining, e.Err)
+}
+
+// Unwrap returns the context's error, so errors.Is(err, context.DeadlineExceeded) works as expected
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// KeyedError is an error returned by an ErrWork, delivered on the Errors channel
+type KeyedError[K comparable] struct {
+	// Key is the key of the work which failed
+	Key K
+	// Err is the error the work returned
+	Err error
+}
+
+// KeyError is a KeyedError for string keys
+type KeyError = KeyedError[string]
+
+func (e KeyedError[K]) Error() string {
+	return fmt.Sprintf("workpool: work for key %q failed: %v", keyString(e.Key), e.Err)
+}
+
+// Unwrap returns the work's error
+func (e KeyedError[K]) Unwrap() error {
+	return e.Err
+}
+
+// KeyedWork is the interface for callers to use this library with keys of any comparable type, such as a struct of a
+// tenant and an entity.  Each unit of work (such as an event) must implement it
+type KeyedWork[K comparable] interface {
 	// Key should return a value that identifies what the work is being performed on
 	//For example:
 	//If account "a" has a creation event, followed by an update, then a cancellation event
 	//All three events should return "a".  This will cause the creation event to process, and the update/cancellation events to queue
-	Key() string
+	Key() K
 
-	// Do should perform the actual work required.  Do is called in its own goroutine
+	// Do should perform the actual work required.  Do is called from one of the workpool's goroutines, or by the executor
+	// given to WithExecutor
 	Do()
 }
 
-// Workpool manages work delivery.  Work is delivered via the Submit function
-type Workpool struct {
-	// how much work is there in total.  This is just for cute metrics or whatever.  Not much real value in this
+// Work is the interface for callers to use this library.  Each unit of work (such as an event) must implement the Work interface
+type Work = KeyedWork[string]
+
+// keyString returns the key as a string, for logs and errors
+func keyString[K comparable](key K) string {
+	if s, ok := any(key).(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// PriorityWork is Work which should jump ahead of lower priority work queued for the same key.  Work which doesn't
+// implement PriorityWork has a priority of 0.  Work of equal priority is still run in FIFO order.
+// Priority only affects queued work: an item that's already running is never preempted
+type PriorityWork interface {
+	Work
+
+	// Priority returns the work's priority.  Higher priorities run first
+	Priority() int
+}
+
+// priority returns the priority of the given work
+func priority(w any) int {
+	if pw, ok := w.(interface{ Priority() int }); ok {
+		return pw.Priority()
+	}
+	return 0
+}
+
+// WeightedWork is Work which occupies more than one slot of the global concurrency limit (see WithMaxConcurrency), such
+// as a batch.  Without a concurrency limit, weight has no effect
+type WeightedWork interface {
+	Work
+
+	// Weight returns how many slots the work occupies while it runs.  Weights below 1 count as 1, and weights above the
+	// concurrency limit count as the whole limit, so that the work can still run
+	Weight() int64
+}
+
+// SizedWork is Work which reports the size of its payload, so that the memory held by queued work can be bounded (see
+// WithMaxQueueBytes) and observed (see Stats).  Work which doesn't implement SizedWork has a size of 0
+type SizedWork interface {
+	Work
+
+	// Size returns roughly how many bytes the work holds on to while it's queued.  Sizes below 0 count as 0.  It must
+	// not change while the work is queued, and work which replaces a duplicate (see WithDedupe) must be the same size
+	Size() int64
+}
+
+// size returns the size of the given work's payload
+func size(w any) int64 {
+	if sw, ok := w.(interface{ Size() int64 }); ok {
+		return max(sw.Size(), 0)
+	}
+	return 0
+}
+
+// LanedWork is Work in a priority lane (see WithPriorityLanes), such as "interactive" rather than "batch".  Lanes rank
+// work across keys: whenever the global concurrency limit frees up a slot, work waiting in a higher lane gets it before
+// work waiting in a lower one.  Work which doesn't implement LanedWork is in lane 0, the lowest
+type LanedWork interface {
+	Work
+
+	// Lane returns the work's lane.  Lanes below 0 count as 0, and lanes beyond those configured count as the highest
+	Lane() int
+}
+
+// TenantWork is Work belonging to a tenant (see WithTenantFairness), such as a customer whose keys share the workpool
+// with other customers' keys.  Work which doesn't implement TenantWork belongs to the tenant with the empty ID
+type TenantWork interface {
+	Work
+
+	// Tenant returns the ID of the tenant which the work belongs to.  All of a key's work should belong to one tenant
+	Tenant() string
+}
+
+// DelayedWork is Work which must not start before a given time.  Ordering within a key is preserved, so a DelayedWork at
+// the head of its key's queue holds up everything queued behind it for that key.  Other keys are unaffected
+type DelayedWork interface {
+	Work
+
+	// NotBefore returns the earliest time the work may start.  A zero or past time means the work may start immediately
+	NotBefore() time.Time
+}
+
+// notBefore returns the earliest time the given work may start
+func notBefore(w any) time.Time {
+	if dw, ok := w.(interface{ NotBefore() time.Time }); ok {
+		return dw.NotBefore()
+	}
+	return time.Time{}
+}
+
+// SequencedWork is Work which carries its own sequence number, such as a message's offset.  With WithReorderWindow, each
+// key runs its SequencedWork in order of Seq, rather than the order it was submitted in
+type SequencedWork interface {
+	Work
+
+	// Seq returns the work's place in its key's sequence
+	Seq() int64
+}
+
+// sequence returns the given work's sequence number, if it's SequencedWork
+func sequence(w any) (int64, bool) {
+	if sw, ok := w.(interface{ Seq() int64 }); ok {
+		return sw.Seq(), true
+	}
+	return 0, false
+}
+
+// DedupeWork is Work which makes any identical work queued just ahead of it redundant.  When the workpool is created
+// with WithDedupe, submitting a DedupeWork replaces the item it would queue behind, if that item is a DedupeWork with
+// the same DedupeID.  Only consecutive duplicates collapse: work with the same DedupeID separated by other work all runs,
+// as does work with the same DedupeID as an item that's already running
+type DedupeWork interface {
+	Work
+
+	// DedupeID identifies the work.  Consecutive work for the same key with the same DedupeID is collapsed into the latest
+	DedupeID() string
+}
+
+// isDuplicate returns whether the later work makes the earlier redundant
+func isDuplicate(earlier, later any) bool {
+	type dedupe interface{ DedupeID() string }
+	e, ok := earlier.(dedupe)
+	if !ok {
+		return false
+	}
+	l, ok := later.(dedupe)
+	return ok && e.DedupeID() == l.DedupeID()
+}
+
+// IdempotentWork is Work which needn't run while an identical item is already running, such as a retried request.  An
+// IdempotentWork submitted while an item with the same key and IdempotencyKey is running is dropped without running,
+// and any Result for it completes with ErrWorkDropped.  Only running work is compared: see DedupeWork for queued work.
+// SubmitResult goes further, and shares the Result of identical work which is queued or running rather than dropping
+// the new work
+type IdempotentWork interface {
+	Work
+
+	// IdempotencyKey identifies the operation the work performs.  Work for the same key with the same IdempotencyKey is
+	// identical
+	IdempotencyKey() string
+}
+
+// idempotencyKey returns the given work's IdempotencyKey, and whether it has one
+func idempotencyKey(w any) (string, bool) {
+	if iw, ok := w.(interface{ IdempotencyKey() string }); ok {
+		return iw.IdempotencyKey(), true
+	}
+	return "", false
+}
+
+// KeyedFuncWork adapts a key and a closure to the KeyedWork interface, for work whose types can't implement it
+// themselves, such as third-party structs.  It's created by FromFunc, and is what a panic handler is given for work
+// from SubmitFunc
+type KeyedFuncWork[K comparable] struct {
+	key K
+	do  func()
+}
+
+// FuncWork is a KeyedFuncWork for string keys
+type FuncWork = KeyedFuncWork[string]
+
+// FromFunc returns Work with the given key, which calls do when it's run
+func FromFunc[K comparable](key K, do func()) KeyedWork[K] {
+	return KeyedFuncWork[K]{key: key, do: do}
+}
+
+func (f KeyedFuncWork[K]) Key() K {
+	return f.key
+}
+
+func (f KeyedFuncWork[K]) Do() {
+	f.do()
+}
+
+// KeyedContextWork is a variant of KeyedWork for work which should be cancellable.  It is submitted via SubmitContext
+type KeyedContextWork[K comparable] interface {
+	// Key has the same meaning as Work's Key
+	Key() K
+
+	// Do performs the work.  The context is the workpool's, and is cancelled when the workpool is closed
+	Do(ctx context.Context)
+}
+
+// ContextWork is a variant of Work for work which should be cancellable.  It is submitted via SubmitContext
+type ContextWork = KeyedContextWork[string]
+
+// contextWork adapts ContextWork to the Work interface, binding it to the context it will be run with
+type contextWork[K comparable] struct {
+	KeyedContextWork[K]
+	ctx context.Context
+}
+
+func (c contextWork[K]) Do() {
+	c.KeyedContextWork.Do(c.ctx)
+}
+
+// runningKey is the context key under which a ContextWork's context records the work's key while it runs
+type runningKey struct{}
+
+// running identifies the key a ContextWork is running for
+type running[K comparable] struct {
+	wp  *KeyedWorkpool[K]
+	key K
+}
+
+// KeyedErrWork is a variant of KeyedWork for work which can fail.  It is submitted via SubmitErr, and any error it
+// returns is delivered on the Errors channel
+type KeyedErrWork[K comparable] interface {
+	// Key has the same meaning as Work's Key
+	Key() K
+
+	// Do performs the work, returning an error if it failed
+	Do() error
+}
+
+// ErrWork is a variant of Work for work which can fail.  It is submitted via SubmitErr, and any error it returns is
+// delivered on the Errors channel
+type ErrWork = KeyedErrWork[string]
+
+// errWork adapts ErrWork to the Work interface.  The manager recognizes it and forwards its error
+type errWork[K comparable] struct {
+	KeyedErrWork[K]
+	// how many times the work has already failed
+	failures int
+	// when the work may be retried
+	retryAt time.Time
+}
+
+func (e errWork[K]) Do() {
+	_ = e.KeyedErrWork.Do()
+}
+
+// NotBefore makes a retried errWork a DelayedWork, so that it waits out its backoff at the head of the queue
+func (e errWork[K]) NotBefore() time.Time {
+	return e.retryAt
+}
+
+// KeyedWorkpool manages work delivery for keys of any comparable type.  Work is delivered via the Submit function.
+// The optional interfaces such as PriorityWork are declared for string keys, but they're recognized by their methods
+// alone, so work with any type of key may implement them
+type KeyedWorkpool[K comparable] struct {
+	cfg config
+	// the config's functions of keys, for this pool's type of key
+	hooks hooks[K]
+
+	// how much work is there in total, both queued and running.  Exposed via QueueLen
 	queueLen *uint64
+	// how many manageKeyQueue goroutines are alive
+	managers *int64
+	// how many items are executing right now
+	running *int64
+	// how many keys are in the pool map
+	tracked *int64
+	// how many managers have been started, and how many idle managers found work as they retired.  Exposed via Stats
+	spawns    *uint64
+	idleRaces *uint64
+	// how many items have waited longer than the starvation threshold for a slot.  Exposed via Stats
+	starvations *uint64
+	// how many items have been dropped for their key being busy.  Exposed via Stats
+	busyDrops *uint64
+	// the sequence number of the last item queued.  Only changed under submitMtx
+	seq *uint64
+	// how many bytes of SizedWork have been submitted but not yet finished.  Exposed via Stats
+	queuedBytes *int64
+	// the idle timeout in nanoseconds, from WithIdleTimeout until SetIdleTimeout changes it
+	idleAfter *int64
+	// how quickly items finish across all keys.  Exposed via Stats
+	throughput *meter
+	// broadcast whenever queueLen, managers, or a key's pending count drops to zero.  Used by Wait and WaitKey
+	idleMtx  sync.Mutex
+	idleCond *sync.Cond
+	// holds submissions while the gate from WithSubmitGate is closed.  nil without a gate
+	gate *submitGate
 
 	submitMtx sync.Mutex
 	// the actual pool of work.  Indexed by key, each value is a queue of work for that key
 	pool *sync.Map
 
-	// a mutex for each key, to notify when new work is ready
+	// a mutex for each key, to notify when new work is ready.  An unordered key has an *unorderedLock instead
 	notif *sync.Map
 
-	// when there's no work, this needs to block with a non-busy method.
-	// When work is added, this needs to pass through
-	noWork *sync.Map
+	// signals that work has been queued for each key, so that an idle manager can block without polling.
+	// Each value is a chan struct{} with a buffer of one: the signal only wakes the manager, which checks the queue itself
+	ready *sync.Map
+
+	// limits how many items may run at once across all keys.  nil if unlimited
+	slots slotLimiter
+	// limits how many items may be submitted but not yet finished, across all keys.  Each submitted item holds a unit
+	// until it finishes.  nil if unlimited
+	capacity *semaphore.Weighted
+	// limits the bytes of SizedWork like capacity does items.  nil if unlimited
+	byteCapacity *semaphore.Weighted
 
 	// goroutines will die after all their work is done and be recreated when more work arrives for them
+	// when a goroutine dies, its key is removed from all of the above maps.
+	// isAlive is only read or written under submitMtx, by Submit when it spawns a manager and by retireKey when the
+	// manager exits, so a Submit either sees the manager alive and leaves the work for it, or spawns a new one
 	isAlive *sync.Map
+
+	// how much work each key has, both queued and running.  Each value is an *int64.  Used by WaitKey
+	pending *sync.Map
+
+	// keys which are paused.  Each value is a chan struct{} which is closed on Resume.  Unlike the maps above, entries
+	// outlive the key's manager, so a key can be paused before its work arrives
+	paused *sync.Map
+	// the circuit breaker of each key with failures (see WithCircuitBreaker).  Each value is a *breaker.  Like paused,
+	// entries outlive the key's manager
+	breakers *sync.Map
+	// whether each key which has crossed the high watermark is still above it (see WithQueueHighWatermark).  Each value
+	// is a *uint32, set to 1 while above.  Deleted along with the key
+	watermarks *sync.Map
+	// how quickly each key's items finish, if tracked (see WithKeyThroughput).  Each value is a *meter.  Deleted along
+	// with the key
+	keyRates *sync.Map
+	// how many of each IdempotentWork are running.  Guarded by inFlightMtx
+	inFlight map[inFlightKey[K]]int
+	// the Result of each IdempotentWork submitted by SubmitResult which hasn't completed.  Guarded by inFlightMtx
+	coalescing  map[inFlightKey[K]]*Result
+	inFlightMtx sync.Mutex
+	// how many items of each key have run for longer than the stall threshold and are still running.  Guarded by
+	// stalledMtx
+	stalled    map[K]int
+	stalledMtx sync.Mutex
+	// set to 1 by PauseAll, so that the dequeue path can check for a global pause without locking
+	pausedAll *uint32
+	// guards resumeAll, and setting pausedAll
+	pauseMtx sync.Mutex
+	// closed by ResumeAll to wake every paused manager.  nil unless the pool is paused
+	resumeAll chan struct{}
+
+	// set to 1 by Shutdown or Close.  Once set, Submit panics and the pool only drains
+	closed *uint32
+	// set to 1 by Drain.  Once set, Submit panics for keys which aren't already tracked
+	draining *uint32
+	// the workpool's context, handed to ContextWork.  Cancelled by Close, after which queued work is dropped
+	ctx    context.Context
+	cancel context.CancelFunc
+	// idle managers wait for work under this context.  Cancelled by Shutdown and Close so that idle managers stop
+	// waiting for work that will never come
+	idleCtx  context.Context
+	wakeIdle context.CancelFunc
+	// failures from ErrWork.  Closed along with drained
+	errs chan KeyedError[K]
+	// lifecycle events.  nil unless WithEvents
+	events chan KeyedEvent[K]
+	// keys whose managers are waiting for work, in the order they went idle.  nil unless WithMaxTrackedKeys
+	idle *idleKeys[K]
+	// the goroutines which keys are hashed onto in place of managers.  nil unless WithShards
+	shards []*shard[K]
+	// the key of each item queued under WithSynchronous, in the order they were queued, and whether a submitter is
+	// running them.  Guarded by syncMtx
+	syncOrder    []K
+	syncDraining bool
+	syncMtx      sync.Mutex
+
+	// closed once the pool is shut down and every submitted item has finished
+	drained   chan struct{}
+	drainOnce sync.Once
 }
 
-type workQueue struct {
-	// queue of work
-	mtx   *sync.Mutex
-	queue []Work
+// Workpool is a KeyedWorkpool for string keys
+type Workpool = KeyedWorkpool[string]
+
+// New instantiates a Workpool.  With no options, a default Workpool is returned
+func New(opts ...Option) *Workpool {
+	return NewKeyed[string](opts...)
 }
 
-func (wq *workQueue) enqueue(w Work) {
-	wq.mtx.Lock()
-	defer wq.mtx.Unlock()
-	wq.queue = append(wq.queue, w)
+// NewWithContext instantiates a Workpool whose lifetime is tied to the given context.  Once the context is done, the
+// workpool is closed as if by Close: idle managers exit, queued work is dropped, and further submissions panic with
+// ErrPoolClosed
+func NewWithContext(ctx context.Context, opts ...Option) *Workpool {
+	return NewKeyedWithContext[string](ctx, opts...)
 }
 
-func (wq *workQueue) deque() Work {
-	wq.mtx.Lock()
-	defer func() {
-		wq.queue = wq.queue[1:]
-		wq.mtx.Unlock()
-	}()
-	return wq.queue[0]
+// NewKeyed instantiates a KeyedWorkpool for keys of type K.  It takes the same options as New.  It panics if an option
+// which takes keys, such as WithOnKeyIdle, was given keys of another type
+func NewKeyed[K comparable](opts ...Option) *KeyedWorkpool[K] {
+	return NewKeyedWithContext[K](context.Background(), opts...)
+}
+
+// NewKeyedWithContext instantiates a KeyedWorkpool for keys of type K, whose lifetime is tied to the given context as
+// with NewWithContext
+func NewKeyedWithContext[K comparable](parent context.Context, opts ...Option) *KeyedWorkpool[K] {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return newKeyed[K](parent, cfg)
+}
+
+// WithSameOptions instantiates a new workpool with the same options as this one, such as for a sub-pipeline.  The new
+// workpool shares nothing else: it starts with no keys, no work and zeroed counters, has its own Errors and Events
+// channels, and lives until it's shut down itself, even if this workpool was tied to a context by NewWithContext.
+// Handlers and other values given to options, such as a LockProvider, are shared as given
+func (wp *KeyedWorkpool[K]) WithSameOptions() *KeyedWorkpool[K] {
+	cfg := wp.cfg
+	cfg.unordered = maps.Clone(cfg.unordered)
+	return newKeyed[K](context.Background(), cfg)
 }
 
-// New instantiates a default Workpool
-func New() *Workpool {
-	return &Workpool{
-		queueLen: new(uint64),
-		pool:     &sync.Map{},
-		notif:    &sync.Map{},
-		noWork:   &sync.Map{},
-		isAlive:  &sync.Map{},
+// newKeyed instantiates a KeyedWorkpool from its config
+func newKeyed[K comparable](parent context.Context, cfg config) *KeyedWorkpool[K] {
+	ctx, cancel := context.WithCancel(parent)
+	idleCtx, wakeIdle := context.WithCancel(ctx)
+	wp := &KeyedWorkpool[K]{
+		cfg:         cfg,
+		hooks:       newHooks[K](cfg),
+		queueLen:    new(uint64),
+		managers:    new(int64),
+		running:     new(int64),
+		tracked:     new(int64),
+		spawns:      new(uint64),
+		idleRaces:   new(uint64),
+		starvations: new(uint64),
+		busyDrops:   new(uint64),
+		seq:         new(uint64),
+		queuedBytes: new(int64),
+		idleAfter:   new(int64),
+		throughput:  &meter{},
+		pool:        &sync.Map{},
+		notif:       &sync.Map{},
+		ready:       &sync.Map{},
+		pending:     &sync.Map{},
+		isAlive:     &sync.Map{},
+		paused:      &sync.Map{},
+		breakers:    &sync.Map{},
+		inFlight:    map[inFlightKey[K]]int{},
+		coalescing:  map[inFlightKey[K]]*Result{},
+		stalled:     map[K]int{},
+		watermarks:  &sync.Map{},
+		keyRates:    &sync.Map{},
+		pausedAll:   new(uint32),
+		closed:      new(uint32),
+		draining:    new(uint32),
+		ctx:         ctx,
+		cancel:      cancel,
+		idleCtx:     idleCtx,
+		wakeIdle:    wakeIdle,
+		errs:        make(chan KeyedError[K], cfg.errBuffer),
+		drained:     make(chan struct{}),
+	}
+	wp.idleCond = sync.NewCond(&wp.idleMtx)
+	atomic.StoreInt64(wp.idleAfter, int64(cfg.idleTimeout))
+	if cfg.events {
+		wp.events = make(chan KeyedEvent[K], eventBuffer)
+	}
+	if cfg.maxTrackedKeys > 0 {
+		wp.idle = newIdleKeys[K]()
+	}
+	for i := 0; i < cfg.shards; i++ {
+		wp.shards = append(wp.shards, &shard[K]{limiters: map[K]*rate.Limiter{}})
+	}
+	if wp.hooks.submitGate != nil {
+		wp.gate = newSubmitGate()
+		// submissions held by the gate give up once the pool is shut down
+		context.AfterFunc(wp.idleCtx, wp.NotifyGateChanged)
+	}
+	if cfg.maxConcurrency > 0 && (cfg.fairDispatch || cfg.priorityLanes > 1 || cfg.tenantFairness) {
+		wp.slots = newDispatcher(int64(cfg.maxConcurrency), cfg.priorityLanes, cfg.tenantFairness)
+	} else if cfg.maxConcurrency > 0 {
+		wp.slots = semaphore.NewWeighted(int64(cfg.maxConcurrency))
+	}
+	if cfg.maxTotalQueue > 0 {
+		wp.capacity = semaphore.NewWeighted(int64(cfg.maxTotalQueue))
+	}
+	if cfg.maxQueueBytes > 0 {
+		wp.byteCapacity = semaphore.NewWeighted(cfg.maxQueueBytes)
 	}
+	// the pool's context is already done along with the parent, which drops queued work and wakes idle managers.  This
+	// closes the pool to submissions too
+	context.AfterFunc(parent, wp.Close)
+	return wp
 }
 
 // manages the work queue for a given key
 //At max, there will be N active goroutines of manageKeyQueue, where N is the number of unique keys
-func (wp *Workpool) manageKeyQueue(key string) {
+func (wp *KeyedWorkpool[K]) manageKeyQueue(key K) {
+	if wp.cfg.threadAffinity {
+		// never unlocked, so that the thread exits along with the manager rather than carrying the key's state elsewhere
+		runtime.LockOSThread()
+	}
+	// created on first use if the key is rate limited, and dropped along with the rest of the key when this returns
+	var limiter *rate.Limiter
 	for {
 		// lock this key's work. just make sure any earlier work on this key is already done
 		notif, _ := wp.notif.Load(key)
-		notif.(*sync.Mutex).Lock()
-
-		// wait 100 ms for any work.  If none comes, die
-		nw, _ := wp.noWork.Load(key)
-		ctx, _ := context.WithDeadline(context.Background(), time.Now().Add(100*time.Millisecond)) //nolint: govet
-		// there's a race between failing to find work and someone giving us work.
-		// the below solution makes the race benign by allowing another copy of this goroutine to be created
-		// the timeouts allow the issue to heal itself.
-		err := nw.(*semaphore.Weighted).Acquire(ctx, 1)
+		notif.(sync.Locker).Lock()
+
+		// wait for any work, for up to the idle timeout.  If none comes, die
+		p, _ := wp.pool.Load(key)
+		wq := p.(keyQueue[K])
+		ready, _ := wp.ready.Load(key)
+		pend, _ := wp.pending.Load(key)
+		pending := pend.(*int64)
+		err := wp.awaitWork(key, wq, ready.(chan struct{}))
 		if err != nil {
-			// mark myself as offline.  Any raced copies of this function are still blocked by the mutex
-			wp.isAlive.Store(key, false)
-			// Do another check.  if there's really no work, then quit.  The second 100ms is a "best effort" synchronization
-			// this allows the Submit function an extra 100ms to spin up a raced copy of this goroutine.
-			// any raced copies of this function are still blocked by the mutex.
-			err := nw.(*semaphore.Weighted).Acquire(ctx, 1)
-			if err != nil {
-				// final point of race: if a piece of work is submitted now, we won't execute it.
-				//another raced groutine will have to take it
-				// free up the mutex for any raced goroutine
-				notif.(*sync.Mutex).Unlock()
-				return
-			}
+			// a purged queue empties without any dequeues
+			wp.belowWatermark(key, wq)
 		}
+		retired := err != nil && wp.retireKey(key, wq, notif.(sync.Locker))
+		if errors.Is(err, errEvicted) {
+			wp.evicted()
+		}
+		if retired {
+			// nobody else can be waiting on the mutex: the key is gone, and a fresh one will be set up by Submit
+			notif.(sync.Locker).Unlock()
+			wp.exitManager(key)
+			return
+		}
+		// a paused manager waits here with its work still queued, so it can't go idle
+		wp.awaitResume(key)
 		// grab the work, since we know some is ready
-		p, _ := wp.pool.Load(key)
-		work := p.(*workQueue).deque()
-
-		// fork off to complete the work.  After the work is completed, unlock the mutex
-		go func() {
-			work.Do()
-			atomic.AddUint64(wp.queueLen, ^uint64(0))
-			notif.(*sync.Mutex).Unlock()
-		}()
-
-		// if we timed out earlier, there's another copy of our goroutine alive
-		// we already marked ourselves as dead.  let the raced copy of our goroutine take over once the work is done
-		// and the mutex is released
-		if err != nil {
+		wp.awaitHead(wq, ready.(chan struct{}))
+		if wp.hooks.keyRateLimit != nil {
+			if limiter == nil {
+				limiter = rate.NewLimiter(wp.hooks.keyRateLimit(key), 1)
+			}
+			// this only fails if the pool is closed, which is checked below
+			_ = limiter.Wait(wp.ctx)
+		}
+		e, ok := wq.deque()
+		if !ok {
+			// the queue was purged after the work was acquired
+			notif.(sync.Locker).Unlock()
+			continue
+		}
+		wp.belowWatermark(key, wq)
+		// the span is nil if tracing is disabled
+		span := wp.startSpan(key, e, wq)
+		wp.debug("workpool: work dequeued", key)
+		// wait for a slot to run in, if concurrency is limited
+		if err := wp.dropReason(key, e); err != nil {
+			// the pool was closed, the submitter lost interest, the work went stale, or its downstream is failing: drop it
+			// rather than running it
+			endSpan(span, err)
+			e.result.complete(err)
+			wp.finish(pending, e.work)
+			notif.(sync.Locker).Unlock()
+			continue
+		}
+
+		// after the work is completed, the mutex is unlocked
+		_, hold := e.work.(holdWork[K])
+		switch {
+		case wp.cfg.threadAffinity:
+			// the work must run on this manager's locked thread
+			wp.run(key, wq, notif.(sync.Locker), pending, e, span)
+		case wp.cfg.executor != nil && !hold:
+			// a MultiKeyWork's hold of a key only waits, and mustn't take a worker its work may need to reach it
+			wp.cfg.executor(func() { wp.run(key, wq, notif.(sync.Locker), pending, e, span) })
+		case wp.inline(notif.(sync.Locker)):
+			wp.run(key, wq, notif.(sync.Locker), pending, e, span)
+		default:
+			go wp.run(key, wq, notif.(sync.Locker), pending, e, span)
+		}
+	}
+}
+
+// inline returns whether a key's manager may run the key's work itself, rather than forking a goroutine for each item.
+// A key runs one item at a time anyway, so that saves a goroutine per key.  It isn't possible for an unordered key,
+// whose items run alongside each other, nor with completion callbacks, which are made after the key is released but
+// must not hold up its next item
+func (wp *KeyedWorkpool[K]) inline(notif sync.Locker) bool {
+	if _, ok := notif.(*unorderedLock); ok {
+		return false
+	}
+	return wp.hooks.onComplete == nil && wp.hooks.onCompleteTimings == nil
+}
+
+// awaitResume blocks while the key or the whole pool is paused.  It returns early if the pool is shut down, so that it
+// can drain
+func (wp *KeyedWorkpool[K]) awaitResume(key K) {
+	for {
+		resumed := wp.pausedUntil(key)
+		if resumed == nil {
+			return
+		}
+		wp.debug("workpool: manager paused", key)
+		select {
+		case <-resumed:
+			// the key may have been paused again in the meantime
+		case <-wp.idleCtx.Done():
+			return
+		}
+	}
+}
+
+// pausedUntil returns a channel which is closed when the key is resumed, or nil if the key isn't paused
+func (wp *KeyedWorkpool[K]) pausedUntil(key K) <-chan struct{} {
+	if resumed, ok := wp.paused.Load(key); ok {
+		return resumed.(chan struct{})
+	}
+	if atomic.LoadUint32(wp.pausedAll) == 0 {
+		return nil
+	}
+	wp.pauseMtx.Lock()
+	defer wp.pauseMtx.Unlock()
+	// nil if the pool was resumed since the flag was checked
+	return wp.resumeAll
+}
+
+// awaitHead blocks until the work at the head of the queue is due to run.  It returns early if the pool is closed.  The
+// key's ready channel, if given, wakes it to check again when more work arrives, which may have changed the head
+func (wp *KeyedWorkpool[K]) awaitHead(wq keyQueue[K], ready <-chan struct{}) {
+	for {
+		d := time.Until(wq.due())
+		if d <= 0 {
+			return
+		}
+		// the head may change while we wait (e.g. for PriorityWork), so check it again afterwards
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ready:
+			// a leftover signal is harmless: awaitWork checks the queue itself
+			timer.Stop()
+		case <-wp.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// expire returns whether the entry has been queued for longer than the queue TTL, reporting it if so
+func (wp *KeyedWorkpool[K]) expire(key K, e entry[K]) bool {
+	// work from a custom Queue has no enqueue time, so it never expires
+	if wp.cfg.queueTTL <= 0 || e.enqueued.IsZero() || time.Since(e.enqueued) <= wp.cfg.queueTTL {
+		return false
+	}
+	wp.debug("workpool: work expired in the queue", key)
+	wp.report(key, ErrWorkExpired)
+	return true
+}
+
+// dropReason returns why the dequeued entry must be dropped rather than run, or nil once it may run.  Work which may run
+// holds its slot under the global concurrency limit, and its key's lock from any lock provider
+func (wp *KeyedWorkpool[K]) dropReason(key K, e entry[K]) error {
+	_, hold := e.work.(holdWork[K])
+	switch {
+	case wp.ctx.Err() != nil:
+		return ErrWorkDropped
+	case hold:
+		// a hold can't be dropped, or its MultiKeyWork would run without holding its key
+		return nil
+	case e.cancelled():
+		return e.ctx.Err()
+	case e.handle.cancelled():
+		return ErrWorkCancelled
+	case wp.expire(key, e):
+		return ErrWorkExpired
+	case wp.tripped(key):
+		return ErrCircuitOpen
+	case isPart(e.work):
+		// a MultiKeyWork takes its slot and its keys' locks once it holds its keys (see doMulti)
+		if !e.handle.start() {
+			return ErrWorkCancelled
+		}
+		return nil
+	case !wp.acquireSlot(e.work):
+		return ErrWorkDropped
+	}
+	if err := wp.acquireLock(key); err != nil {
+		wp.releaseSlot(e.work)
+		return err
+	}
+	if !e.handle.start() {
+		// cancelled while waiting for the slot or the lock
+		wp.releaseLock(key)
+		wp.releaseSlot(e.work)
+		return ErrWorkCancelled
+	}
+	return nil
+}
+
+// acquireSlot blocks until the work may run under the global concurrency limit, if there is one.
+// It returns false if the pool is closed while waiting
+func (wp *KeyedWorkpool[K]) acquireSlot(w KeyedWork[K]) bool {
+	if wp.slots == nil {
+		return true
+	}
+	if wp.hooks.onStarvation != nil {
+		defer wp.watchStarvation(w.Key())()
+	}
+	if d, ok := wp.slots.(*dispatcher); ok {
+		return d.acquire(wp.ctx, wp.weight(w), wp.lane(w), wp.tenant(w)) == nil
+	}
+	return wp.slots.Acquire(wp.ctx, wp.weight(w)) == nil
+}
+
+func (wp *KeyedWorkpool[K]) releaseSlot(w KeyedWork[K]) {
+	if d, ok := wp.slots.(*dispatcher); ok {
+		d.release(wp.weight(w), wp.tenant(w))
+	} else if wp.slots != nil {
+		wp.slots.Release(wp.weight(w))
+	}
+}
+
+// tenant returns the tenant whose share of the concurrency slots the given work runs in.  Without WithTenantFairness,
+// all work is in the same tenant
+func (wp *KeyedWorkpool[K]) tenant(w KeyedWork[K]) string {
+	if !wp.cfg.tenantFairness {
+		return ""
+	}
+	if tw, ok := w.(interface{ Tenant() string }); ok {
+		return tw.Tenant()
+	}
+	return ""
+}
+
+// lane returns which of the configured priority lanes the given work waits for a slot in
+func (wp *KeyedWorkpool[K]) lane(w KeyedWork[K]) int {
+	lw, ok := w.(interface{ Lane() int })
+	if !ok {
+		return 0
+	}
+	return min(max(lw.Lane(), 0), max(wp.cfg.priorityLanes-1, 0))
+}
+
+// weight returns how many slots the given work occupies under the concurrency limit
+func (wp *KeyedWorkpool[K]) weight(w KeyedWork[K]) int64 {
+	ww, ok := w.(interface{ Weight() int64 })
+	if !ok {
+		return 1
+	}
+	n := ww.Weight()
+	if n < 1 {
+		return 1
+	}
+	if limit := int64(wp.cfg.maxConcurrency); n > limit {
+		return limit
+	}
+	return n
+}
+
+// retireKey is called by an idle manager.  There's a race between failing to find work and someone giving us work, so
+// the decision is made under the submit mutex: if the queue is provably empty then the key's entries are deleted from
+// every map and true is returned, after which the manager must exit via exitManager.  Otherwise work arrived in the
+// meantime, and false is returned.  An unordered key isn't retired while any of its work is still running, so that a
+// fresh key can't exceed its parallelism
+func (wp *KeyedWorkpool[K]) retireKey(key K, wq keyQueue[K], notif sync.Locker) bool {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+	if wq.len() > 0 {
+		wp.debug("workpool: work arrived as the manager was going idle", key)
+		atomic.AddUint64(wp.idleRaces, 1)
+		return false
+	}
+	if l, ok := notif.(*unorderedLock); ok && l.holders() > 1 {
+		return false
+	}
+	wp.debug("workpool: manager exiting after idle timeout", key)
+	wp.pool.Delete(key)
+	wp.notif.Delete(key)
+	wp.ready.Delete(key)
+	wp.pending.Delete(key)
+	wp.isAlive.Delete(key)
+	wp.watermarks.Delete(key)
+	wp.keyRates.Delete(key)
+	atomic.AddInt64(wp.tracked, -1)
+	return true
+}
+
+// exitManager is the last thing a retired manager does.  The idle callback is called outside of any lock, so it may
+// submit more work.  The manager is counted until the callback returns, so that Wait covers it
+func (wp *KeyedWorkpool[K]) exitManager(key K) {
+	wp.emit(ManagerStopped, key)
+	if wp.hooks.onKeyIdle != nil {
+		wp.hooks.onKeyIdle(key)
+	}
+	if atomic.AddInt64(wp.managers, -1) == 0 {
+		wp.signalIdle()
+	}
+}
+
+// SetIdleTimeout changes the idle timeout given to WithIdleTimeout while the workpool runs, for example to lengthen it
+// under heavy load so that managers aren't torn down between bursts, and to shorten it under light load so that idle
+// managers exit sooner.  Managers which are already waiting for work wait out the timeout they started with, so the
+// change applies from the next time each key goes idle.  Any jitter (see WithIdleJitter) applies to the new timeout.
+// A timeout of 0 retires each key as soon as its queue empties, and a negative one is taken as 0
+func (wp *KeyedWorkpool[K]) SetIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(wp.idleAfter, int64(max(d, 0)))
+}
+
+// idleTimeout returns how long a manager waits for work before going idle, including any jitter
+func (wp *KeyedWorkpool[K]) idleTimeout() time.Duration {
+	d := time.Duration(atomic.LoadInt64(wp.idleAfter))
+	if d <= 0 || wp.cfg.idleJitter <= 0 {
+		return d
+	}
+	// no more than the timeout can be lengthened by without overflowing
+	limit := math.MaxInt64 - int64(d)
+	spread := limit
+	if f := float64(d) * wp.cfg.idleJitter; f < float64(limit) {
+		spread = min(int64(f), limit)
+	}
+	return d + time.Duration(rand.Int63n(spread+1))
+}
+
+// awaitWork blocks until the queue has work, for up to the idle timeout.  It returns an error if none arrives in time,
+// if the pool is shut down while waiting, or with errEvicted if the key is evicted (see WithMaxTrackedKeys).  Work that
+// is already queued is always taken, even if the pool is shut down: this lets a shut down pool finish its queue
+func (wp *KeyedWorkpool[K]) awaitWork(key K, wq keyQueue[K], ready <-chan struct{}) error {
+	if wq.len() > 0 {
+		// a hot key never needs the deadline
+		return nil
+	}
+	// the deadline is derived from the pool's context, so a Shutdown wakes idle managers immediately
+	ctx, cancel := context.WithDeadline(wp.idleCtx, time.Now().Add(wp.idleTimeout()))
+	defer cancel()
+	stopIdle := wp.markIdle(key, cancel)
+	// a signal may be left over from work which was taken without waiting for it, so check the queue on each wake
+	for wq.len() == 0 {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			if stopIdle() {
+				return errEvicted
+			}
+			return ctx.Err()
+		}
+	}
+	if stopIdle() {
+		// evicted just as work arrived, so the key stays
+		wp.evicted()
+	}
+	return nil
+}
+
+// run performs the given work, then unlocks its key.  A panicking Do still unlocks the key, then the panic is handed to
+// the panic handler.  The handler and any completion callback are called outside the lock.  The manager runs the work
+// itself unless it needs a goroutine of its own (see inline), so the panic handler may hold up the key's next item.  It
+// returns whether the work was put back in the queue, to be retried or resumed
+func (wp *KeyedWorkpool[K]) run(key K, wq keyQueue[K], notif sync.Locker, pending *int64, e entry[K], span trace.Span) (requeued bool) {
+	work := e.work
+	var err error
+	defer func() {
+		if !requeued {
+			wp.finish(pending, work)
+		}
+	}()
+	start := time.Now()
+	var queueWait time.Duration
+	if !e.enqueued.IsZero() {
+		queueWait = start.Sub(e.enqueued)
+	}
+	defer func() {
+		r := recover()
+		elapsed := time.Since(start)
+		var stack []byte
+		if r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			// still the panicking goroutine's stack, since the deferred call runs on top of it
+			stack = debug.Stack()
+		}
+		endSpan(span, err)
+		if !requeued {
+			// before the key moves on, so that the key's next item sees the outcome, and its Results complete in order
+			wp.recordOutcome(key, err)
+			e.result.complete(err)
+			wp.audit(key, e, start, start.Add(elapsed))
+			wp.markCompleted(key, start.Add(elapsed))
+		}
+		if !isPart(work) {
+			wp.releaseLock(key)
+			wp.releaseSlot(work)
+		}
+		if r != nil {
+			wp.emit(ItemPanicked, key)
+		} else {
+			wp.emit(ItemCompleted, key)
+		}
+		notif.Unlock()
+		if r != nil {
+			wp.hooks.panicHandler(work, r, stack)
+		}
+		wp.debug("workpool: work completed", key)
+		if wp.hooks.onComplete != nil {
+			wp.hooks.onComplete(key, elapsed)
+		}
+		if wp.hooks.onCompleteTimings != nil {
+			wp.hooks.onCompleteTimings(key, queueWait, elapsed)
+		}
+	}()
+	if span != nil {
+		span.AddEvent("started")
+	}
+	wp.emit(ItemStarted, key)
+	defer wp.trackInFlight(work)()
+	if e.started != nil {
+		close(e.started)
+		// a retry or a resumption isn't a start
+		e.started = nil
+	}
+	atomic.AddInt64(wp.running, 1)
+	defer atomic.AddInt64(wp.running, -1)
+	switch err = wp.do(key, work); {
+	case errors.Is(err, errYielded):
+		// not done, so nothing to report
+		err = nil
+		wp.requeue(wq, e)
+		requeued = true
+	case err != nil:
+		requeued = wp.retryOrReport(wq, e, err)
+	}
+	return requeued
+}
+
+// do performs the given work, returning the error from an ErrWork, or errYielded if a ResumableWork yielded.  Work which overruns the configured timeout is
+// reported on the Errors channel
+func (wp *KeyedWorkpool[K]) do(key K, w KeyedWork[K]) error {
+	switch w := w.(type) {
+	case multiWork[K]:
+		return wp.doMulti(key, w)
+	case holdWork[K]:
+		wp.hold(w)
+		return nil
+	}
+	if wp.cfg.stallThreshold > 0 {
+		defer wp.watchStall(key)()
+	}
+	if cw, ok := w.(contextWork[K]); ok {
+		// marked with the key, so that the work can't wait on itself (see WaitKey)
+		ctx := context.WithValue(cw.ctx, runningKey{}, running[K]{wp: wp, key: key})
+		if wp.cfg.workTimeout <= 0 {
+			cw.KeyedContextWork.Do(ctx)
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, wp.cfg.workTimeout)
+		defer cancel()
+		cw.KeyedContextWork.Do(ctx)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			wp.report(key, ErrWorkTimeout)
+		}
+		return nil
+	}
+	if wp.cfg.workTimeout > 0 {
+		defer wp.watchOverrun(key)()
+	}
+	if ew, ok := w.(errWork[K]); ok {
+		return ew.KeyedErrWork.Do()
+	}
+	if rw, ok := w.(resumableWork[K]); ok {
+		if !rw.KeyedResumableWork.Do() {
+			return errYielded
+		}
+		return nil
+	}
+	w.Do()
+	return nil
+}
+
+// retryOrReport puts failed work back at the head of its queue if it has attempts left (see WithRetry), and returns
+// true.  Otherwise the error is delivered on the Errors channel, and false is returned.
+// The key must still be locked, so that nothing else for it can run in the meantime
+func (wp *KeyedWorkpool[K]) retryOrReport(wq keyQueue[K], e entry[K], err error) bool {
+	w := e.work.(errWork[K])
+	w.failures++
+	if w.failures < wp.cfg.retryAttempts {
+		w.retryAt = time.Now().Add(wp.cfg.retryBackoff(w.failures))
+		e.work = w
+		wq.pushFront(e)
+		return true
+	}
+	wp.report(w.Key(), err)
+	return false
+}
+
+// report delivers the error on the Errors channel, unless it's full
+func (wp *KeyedWorkpool[K]) report(key K, err error) {
+	select {
+	case wp.errs <- KeyedError[K]{Key: key, Err: err}:
+	default:
+		// nobody is keeping up with the errors.  Don't hold up the key for them
+	}
+}
+
+// watchOverrun reports an ErrWorkTimeout for the key if the returned function isn't called within the work timeout.
+// The returned function doesn't return until any report has been made, so that the work can't finish (and close the
+// Errors channel) underneath it
+func (wp *KeyedWorkpool[K]) watchOverrun(key K) func() {
+	reported := make(chan struct{})
+	t := time.AfterFunc(wp.cfg.workTimeout, func() {
+		wp.debug("workpool: work exceeded its timeout", key)
+		wp.report(key, ErrWorkTimeout)
+		close(reported)
+	})
+	return func() {
+		if !t.Stop() {
+			<-reported
+		}
+	}
+}
+
+// watchStarvation calls the starvation callback for the key if the returned function isn't called within the starvation
+// threshold (see WithOnStarvation)
+func (wp *KeyedWorkpool[K]) watchStarvation(key K) func() {
+	start := time.Now()
+	t := time.AfterFunc(wp.cfg.starvationThreshold, func() {
+		wp.debug("workpool: key starved of a concurrency slot", key)
+		atomic.AddUint64(wp.starvations, 1)
+		wp.hooks.onStarvation(key, time.Since(start))
+	})
+	return func() {
+		t.Stop()
+	}
+}
+
+// watchStall marks the key as stalled, and calls the stall callback, if the returned function isn't called within the
+// stall threshold (see WithStallDetector).  The returned function unmarks the key
+func (wp *KeyedWorkpool[K]) watchStall(key K) func() {
+	start := time.Now()
+	stalled := make(chan struct{})
+	t := time.AfterFunc(wp.cfg.stallThreshold, func() {
+		wp.debug("workpool: work stalled", key)
+		wp.stalledMtx.Lock()
+		wp.stalled[key]++
+		wp.stalledMtx.Unlock()
+		close(stalled)
+		if wp.hooks.onStall != nil {
+			wp.hooks.onStall(key, time.Since(start))
+		}
+	})
+	return func() {
+		if t.Stop() {
 			return
 		}
+		<-stalled
+		wp.stalledMtx.Lock()
+		defer wp.stalledMtx.Unlock()
+		if wp.stalled[key]--; wp.stalled[key] == 0 {
+			delete(wp.stalled, key)
+		}
+	}
+}
+
+// finish marks the given work as complete, and notifies Shutdown if it was the last.  pending is the work's key's
+// counter.  It's handed over rather than looked up, since the key may have been retired and set up afresh meanwhile
+func (wp *KeyedWorkpool[K]) finish(pending *int64, w KeyedWork[K]) {
+	if atomic.AddInt64(pending, -1) == 0 {
+		wp.signalIdle()
+	}
+	remaining := atomic.AddUint64(wp.queueLen, ^uint64(0))
+	if finishPart(w) {
+		wp.unreserve(w)
+	}
+	if remaining != 0 {
+		return
+	}
+	wp.signalIdle()
+	if atomic.LoadUint32(wp.closed) == 1 {
+		wp.markDrained()
+	}
+}
+
+// reserve blocks until the items fit under the total queue limit and the byte limit, if there are any.  It panics with
+// ErrPoolClosed if the pool is shut down while waiting, rather than waiting for room the submission couldn't use
+func (wp *KeyedWorkpool[K]) reserve(items ...KeyedWork[K]) {
+	if wp.capacity != nil && wp.capacity.Acquire(wp.idleCtx, int64(len(items))) != nil {
+		panic(ErrPoolClosed)
+	}
+	bytes := wp.size(items)
+	if wp.byteCapacity != nil && wp.byteCapacity.Acquire(wp.idleCtx, bytes) != nil {
+		if wp.capacity != nil {
+			wp.capacity.Release(int64(len(items)))
+		}
+		panic(ErrPoolClosed)
+	}
+	atomic.AddInt64(wp.queuedBytes, bytes)
+}
+
+// tryReserve is reserve without the wait.  It returns false if the items don't fit
+func (wp *KeyedWorkpool[K]) tryReserve(items ...KeyedWork[K]) bool {
+	if wp.capacity != nil && !wp.capacity.TryAcquire(int64(len(items))) {
+		return false
+	}
+	bytes := wp.size(items)
+	if wp.byteCapacity != nil && !wp.byteCapacity.TryAcquire(bytes) {
+		if wp.capacity != nil {
+			wp.capacity.Release(int64(len(items)))
+		}
+		return false
+	}
+	atomic.AddInt64(wp.queuedBytes, bytes)
+	return true
+}
+
+// unreserve gives back the room held by the items under the total queue limit and the byte limit
+func (wp *KeyedWorkpool[K]) unreserve(items ...KeyedWork[K]) {
+	if wp.capacity != nil {
+		wp.capacity.Release(int64(len(items)))
+	}
+	bytes := wp.size(items)
+	if wp.byteCapacity != nil {
+		wp.byteCapacity.Release(bytes)
+	}
+	atomic.AddInt64(wp.queuedBytes, -bytes)
+}
+
+// size returns how many bytes the items count as under the byte limit.  Each item counts as no more than the whole limit
+func (wp *KeyedWorkpool[K]) size(items []KeyedWork[K]) int64 {
+	var total int64
+	for _, w := range items {
+		if wp.cfg.maxQueueBytes > 0 {
+			total += min(size(w), wp.cfg.maxQueueBytes)
+		} else {
+			total += size(w)
+		}
+	}
+	return total
+}
+
+// debug logs the given message for the key at debug level.  It's cheap when debug logging is disabled
+func (wp *KeyedWorkpool[K]) debug(msg string, key K) {
+	if wp.cfg.logger.Enabled(context.Background(), slog.LevelDebug) {
+		wp.cfg.logger.Debug(msg, "key", key)
+	}
+}
+
+// signalIdle wakes anything in Wait or WaitKey to recheck whether the pool or key is idle
+func (wp *KeyedWorkpool[K]) signalIdle() {
+	wp.idleMtx.Lock()
+	defer wp.idleMtx.Unlock()
+	wp.idleCond.Broadcast()
+}
+
+// markDrained must only be called once the pool is closed and no work remains
+func (wp *KeyedWorkpool[K]) markDrained() {
+	wp.drainOnce.Do(func() {
+		close(wp.errs)
+		close(wp.drained)
+	})
+}
+
+// SubmitFunc submits the given function as work for the given key.  It behaves exactly like Submit.
+func (wp *KeyedWorkpool[K]) SubmitFunc(key K, fn func()) {
+	wp.Submit(FromFunc(key, fn))
+}
+
+// SubmitValue submits fn as work for the given key, like SubmitFunc, and returns a channel on which fn's result is
+// delivered once it has run.  The channel is buffered, so an unread result doesn't hold up the key.  The channel is
+// closed after the result is delivered, or without a result if fn panics
+func SubmitValue[T any, K comparable](wp *KeyedWorkpool[K], key K, fn func() T) <-chan T {
+	ch := make(chan T, 1)
+	wp.SubmitFunc(key, func() {
+		defer close(ch)
+		ch <- fn()
+	})
+	return ch
+}
+
+// SubmitStream submits each of fns as work for the given key, like SubmitValue, and returns a channel on which their
+// results are delivered in the order given.  The key's work runs in order, so each result is delivered as soon as its
+// fn returns.  The fns are submitted as a batch (see SubmitBatch), so no other work for the key runs between them.  The
+// channel is buffered to hold every result, so an unread stream doesn't hold up the key.  It's closed once every fn has
+// run, or straight away if WithDropWhileBusy drops them, or never if Close drops any of them.  A fn which panics
+// delivers no result, and the stream carries on with the next
+func SubmitStream[T any, K comparable](wp *KeyedWorkpool[K], key K, fns []func() T) <-chan T {
+	ch := make(chan T, len(fns))
+	if len(fns) == 0 {
+		close(ch)
+		return ch
 	}
+	left := int64(len(fns))
+	items := make([]KeyedWork[K], 0, len(fns))
+	for _, fn := range fns {
+		items = append(items, FromFunc(key, func() {
+			defer func() {
+				if atomic.AddInt64(&left, -1) == 0 {
+					close(ch)
+				}
+			}()
+			ch <- fn()
+		}))
+	}
+	if wp.submitBatch(items)[key] {
+		// the key was busy (see WithDropWhileBusy), so none of them will run
+		close(ch)
+	}
+	return ch
+}
+
+// SubmitContext submits the given context-aware work.  It behaves exactly like Submit, except that the work is handed
+// the workpool's context when it runs.  Note that a panic handler is given the work wrapped in an adapter to Work
+func (wp *KeyedWorkpool[K]) SubmitContext(w KeyedContextWork[K]) {
+	wp.Submit(contextWork[K]{KeyedContextWork: w, ctx: wp.ctx})
+}
+
+// SubmitErr submits the given fallible work.  It behaves exactly like Submit, except that if the work returns an error
+// it is delivered on the Errors channel.  Note that a panic handler is given the work wrapped in an adapter to Work
+func (wp *KeyedWorkpool[K]) SubmitErr(w KeyedErrWork[K]) {
+	wp.Submit(errWork[K]{KeyedErrWork: w})
+}
+
+// Errors returns the channel on which failures from ErrWork are delivered.  The channel is buffered (see
+// WithErrorBuffer), and errors are dropped rather than holding up work when the buffer is full.  The channel is closed
+// once a shut down workpool has drained.
+func (wp *KeyedWorkpool[K]) Errors() <-chan KeyedError[K] {
+	return wp.errs
 }
 
 // Submit submits the given work to the workpool.  If other work is already in place with the same key, then this work
-// will be queued.  Order is guaranteed as a FIFO queue.
-func (wp *Workpool) Submit(w Work) {
+// will be queued.  Order is guaranteed as a FIFO queue.  Work may submit more work for its own key: the new item is
+// queued behind it, and runs once it has returned, so the work must not wait for the new item (see WaitKey).  Submit
+// blocks while the workpool is full (see WithMaxTotalQueue).
+// Submit returns a func which cancels the work if it hasn't started yet, for work which turns out to be obsolete before
+// it runs: cancelled work is taken out of its key's queue and never runs, and the func returns true.  Once the work has
+// started, or if it has already been cancelled, the func does nothing and returns false, as it does if the work was
+// dropped rather than queued (see WithDropWhileBusy and IdempotentWork), or replaced (see WithDedupe and ReplaceHead).
+// Submit panics with ErrPoolClosed if the workpool has been shut down, including while Submit is blocked on a full
+// workpool, with ErrNilWork if w is nil, and with ErrEmptyKey if w's key is the empty string.  Every other way of
+// submitting work panics likewise, except SubmitOrErr, which returns the error instead.
+func (wp *KeyedWorkpool[K]) Submit(w KeyedWork[K]) (cancel func() bool) {
+	wp.awaitGate(w)
+	wp.reserve(w)
+	defer wp.drainSync()
+	defer wp.aboveWatermark(w)
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	h := &handle{}
+	wp.submitLocked(entry[K]{work: w, handle: h})
+	return wp.canceller(w.Key(), h)
+}
+
+// SubmitCtx submits the given work like Submit, scoped to ctx: if ctx is done by the time the work reaches the head of
+// its key's queue, the work is dropped without running.  This suits request-scoped work which becomes irrelevant once
+// the request is gone.  Work which has already started is unaffected, and dropped work still counts towards QueueLen
+// until it reaches the head of the queue.  To cancel work which is running, use SubmitContext
+func (wp *KeyedWorkpool[K]) SubmitCtx(ctx context.Context, w KeyedWork[K]) {
+	wp.awaitGate(w)
+	wp.reserve(w)
+	defer wp.drainSync()
+	defer wp.aboveWatermark(w)
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	wp.submitLocked(entry[K]{work: w, ctx: ctx})
+}
+
+// TrySubmit submits the given work like Submit, unless the work's key already has as many items queued as allowed by
+// WithMaxQueueDepth, or the workpool is full (see WithMaxTotalQueue).  In that case the work is not submitted, and false
+// is returned.  An item which is currently running does not count towards the depth.  Without either option, TrySubmit
+// always submits the work.
+// TrySubmit panics with ErrPoolClosed if the workpool has been shut down.
+func (wp *KeyedWorkpool[K]) TrySubmit(w KeyedWork[K]) bool {
+	if !wp.gateOpen(w) || !wp.tryReserve(w) {
+		return false
+	}
+	defer wp.drainSync()
+	defer wp.aboveWatermark(w)
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	if err := wp.admits(w); err != nil {
+		wp.unreserve(w)
+		panic(err)
+	}
+	if wp.cfg.maxQueueDepth > 0 && wp.KeyQueueLen(w.Key()) >= wp.cfg.maxQueueDepth {
+		wp.unreserve(w)
+		return false
+	}
+	wp.enqueueLocked(entry[K]{work: w})
+	return true
+}
+
+// SubmitOrErr submits the given work like TrySubmit, but returns why the work wasn't submitted rather than panicking or
+// returning false, so that the caller can decide what to shed.  It returns ErrPoolClosed if the workpool has been shut
+// down, ErrPaused if the work's key is paused (see Pause and PauseAll), ErrGateClosed if the gate from WithSubmitGate is
+// closed, or ErrQueueFull under the limits which TrySubmit honours.  It returns the errors Submit panics with, such as
+// ErrDraining and ErrNilWork, likewise.  It returns nil once the work is submitted
+func (wp *KeyedWorkpool[K]) SubmitOrErr(w KeyedWork[K]) error {
+	// checked again under the lock, but a closed pool mustn't look full
+	if atomic.LoadUint32(wp.closed) == 1 {
+		return ErrPoolClosed
+	}
+	if !wp.gateOpen(w) {
+		return ErrGateClosed
+	}
+	if !wp.tryReserve(w) {
+		return ErrQueueFull
+	}
+	defer wp.drainSync()
+	defer wp.aboveWatermark(w)
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	err := wp.admits(w)
+	switch {
+	case err != nil:
+	case wp.pausedUntil(w.Key()) != nil:
+		err = ErrPaused
+	case wp.cfg.maxQueueDepth > 0 && wp.KeyQueueLen(w.Key()) >= wp.cfg.maxQueueDepth:
+		err = ErrQueueFull
+	default:
+		wp.enqueueLocked(entry[K]{work: w})
+		return nil
+	}
+	wp.unreserve(w)
+	return err
+}
+
+// SubmitBatch submits every item in the batch under a single acquisition of the submit lock, so no other submitter can
+// interleave work between them: items sharing a key are queued contiguously, in the order given.  Items with differing
+// keys run in parallel as usual.  Contiguity doesn't extend to PriorityWork, which is queued by priority as usual.  On
+// a LIFO key (see WithKeyOrdering), the batch is queued behind the key's work, rather than ahead of it, to keep its
+// order.  Under WithDropWhileBusy, a key's items are all dropped or all queued, depending on whether it's busy.
+// SubmitBatch panics with ErrPoolClosed, having submitted nothing, if the workpool has been shut down, with
+// ErrDraining if it is draining and any item's key isn't tracked, or with ErrBatchTooLarge if the batch is larger than
+// WithMaxTotalQueue allows.
+func (wp *KeyedWorkpool[K]) SubmitBatch(items []KeyedWork[K]) {
+	wp.submitBatch(items)
+}
+
+// submitBatch does the work of SubmitBatch, and returns the keys whose items were dropped
+func (wp *KeyedWorkpool[K]) submitBatch(items []KeyedWork[K]) (dropped map[K]bool) {
+	if wp.cfg.maxTotalQueue > 0 && len(items) > wp.cfg.maxTotalQueue {
+		panic(ErrBatchTooLarge)
+	}
+	if wp.cfg.maxQueueBytes > 0 && wp.size(items) > wp.cfg.maxQueueBytes {
+		panic(ErrBatchTooLarge)
+	}
+	for _, w := range items {
+		wp.awaitGate(w)
+	}
+	wp.reserve(items...)
+	defer wp.drainSync()
+	defer func() {
+		for _, w := range items {
+			wp.aboveWatermark(w)
+		}
+	}()
 	wp.submitMtx.Lock()
 	defer wp.submitMtx.Unlock()
 
+	for _, w := range items {
+		if err := wp.admits(w); err != nil {
+			wp.unreserve(items...)
+			panic(err)
+		}
+	}
+	// the first item for each key is dropped if the key is busy (see WithDropWhileBusy), and the rest go with it
+	dropped = map[K]bool{}
+	for _, w := range items {
+		e := entry[K]{work: w, fifo: true}
+		if first, ok := dropped[w.Key()]; ok {
+			e.keep = !first
+			wp.enqueueLocked(e)
+		} else {
+			dropped[w.Key()] = !wp.enqueueLocked(e)
+		}
+	}
+	return dropped
+}
+
+// submitLocked does the work of Submit.  The submit mutex must be held
+func (wp *KeyedWorkpool[K]) submitLocked(e entry[K]) {
+	if err := wp.admits(e.work); err != nil {
+		wp.unreserve(e.work)
+		panic(err)
+	}
+	wp.enqueueLocked(e)
+}
+
+// admits returns why the work can't be submitted, or nil if it can.  The submit mutex must be held
+func (wp *KeyedWorkpool[K]) admits(w KeyedWork[K]) error {
+	if isNil(w) {
+		return ErrNilWork
+	}
+	if mw, ok := w.(KeyedMultiKeyWork[K]); ok {
+		for _, key := range mw.Keys() {
+			if err := wp.accepts(key); err != nil {
+				return err
+			}
+		}
+	}
+	return wp.accepts(w.Key())
+}
+
+// isNil returns whether the work is nil, including work wrapped by SubmitErr or SubmitContext
+func isNil[K comparable](w KeyedWork[K]) bool {
+	switch w := w.(type) {
+	case nil:
+		return true
+	case errWork[K]:
+		return w.KeyedErrWork == nil
+	case contextWork[K]:
+		return w.KeyedContextWork == nil
+	case resumableWork[K]:
+		return w.KeyedResumableWork == nil
+	}
+	return false
+}
+
+// accepts returns why work for the key can't be submitted, or nil if it can.  The submit mutex must be held
+func (wp *KeyedWorkpool[K]) accepts(key K) error {
+	// the context may be done a moment before Close runs
+	if atomic.LoadUint32(wp.closed) == 1 || wp.ctx.Err() != nil {
+		return ErrPoolClosed
+	}
+	if s, ok := any(key).(string); ok && s == "" {
+		return ErrEmptyKey
+	}
+	if atomic.LoadUint32(wp.draining) == 1 {
+		if _, ok := wp.notif.Load(key); !ok {
+			return ErrDraining
+		}
+	}
+	return nil
+}
+
+// enqueueLocked queues the work, setting up its key and starting its manager if need be, and returns true.  It returns
+// false if the work was dropped rather than queued.  The submit mutex must be held
+func (wp *KeyedWorkpool[K]) enqueueLocked(e entry[K]) bool {
+	w := e.work
+	if mw, ok := w.(KeyedMultiKeyWork[K]); ok && !wp.cfg.synchronous && wp.shards == nil {
+		wp.enqueueMultiLocked(e, mw)
+		return true
+	}
+	if wp.isInFlight(w) {
+		wp.debug("workpool: identical work is already running", w.Key())
+		e.handle.drop()
+		e.result.complete(ErrWorkDropped)
+		wp.unreserve(w)
+		return false
+	}
+	if wp.busy(e) {
+		wp.debug("workpool: key is busy", w.Key())
+		atomic.AddUint64(wp.busyDrops, 1)
+		wp.emit(ItemDropped, w.Key())
+		e.handle.drop()
+		e.result.complete(ErrWorkDropped)
+		wp.unreserve(w)
+		return false
+	}
+	e.seq = atomic.AddUint64(wp.seq, 1)
 	// the notif map is recycled to indicate whether the key has ever been seen before
 	if _, ok := wp.notif.Load(w.Key()); !ok {
-		// if this is the first time we've seen this key, set everything up
-		wp.pool.Store(w.Key(), &workQueue{queue: make([]Work, 0), mtx: &sync.Mutex{}})
-		wp.notif.Store(w.Key(), &sync.Mutex{})
-		sem := semaphore.NewWeighted(math.MaxInt64)
-		wp.noWork.Store(w.Key(), sem)
-		wp.isAlive.Store(w.Key(), false)
-
-		err := sem.Acquire(context.TODO(), math.MaxInt64)
-		must(err)
+		wp.setupKey(w.Key())
 	}
 
 	pool, _ := wp.pool.Load(w.Key())
-	pool.(*workQueue).enqueue(w)
+	if !pool.(keyQueue[K]).enqueue(e) {
+		// the work replaced a duplicate, which was already counted
+		wp.unreserve(w)
+		return true
+	}
 
 	atomic.AddUint64(wp.queueLen, 1)
+	pending, _ := wp.pending.Load(w.Key())
+	atomic.AddInt64(pending.(*int64), 1)
 
-	sem, _ := wp.noWork.Load(w.Key())
-	sem.(*semaphore.Weighted).Release(1)
+	ready, _ := wp.ready.Load(w.Key())
+	select {
+	case ready.(chan struct{}) <- struct{}{}:
+	default:
+		// the manager already has a wake up pending
+	}
+
+	if wp.cfg.synchronous {
+		// run by the submitter once the submit mutex is released
+		wp.syncMtx.Lock()
+		wp.syncOrder = append(wp.syncOrder, w.Key())
+		wp.syncMtx.Unlock()
+		return true
+	}
+	wp.startManager(w.Key())
+	return true
+}
 
-	if isAlive, _ := wp.isAlive.Load(w.Key()); !isAlive.(bool) {
-		wp.isAlive.Store(w.Key(), true)
-		go wp.manageKeyQueue(w.Key())
+// busy returns whether the work must be dropped because its key already has work (see WithDropWhileBusy).  The submit
+// mutex must be held
+func (wp *KeyedWorkpool[K]) busy(e entry[K]) bool {
+	if !wp.cfg.dropWhileBusy || e.keep || isPart(e.work) {
+		return false
 	}
+	pending, ok := wp.pending.Load(e.work.Key())
+	return ok && atomic.LoadInt64(pending.(*int64)) > 0
 }
 
-func must(e error) {
-	if e != nil {
-		panic(e)
+// startManager starts the key's manager, unless it's already alive.  The key must be set up, and the submit mutex must
+// be held
+func (wp *KeyedWorkpool[K]) startManager(key K) {
+	if wp.cfg.synchronous {
+		// submitters run the work themselves
+		return
 	}
+	if isAlive, _ := wp.isAlive.Load(key); !isAlive.(bool) {
+		wp.isAlive.Store(key, true)
+		atomic.AddInt64(wp.managers, 1)
+		atomic.AddUint64(wp.spawns, 1)
+		wp.debug("workpool: manager started", key)
+		wp.emit(ManagerStarted, key)
+		if wp.shards != nil {
+			wp.shardOf(key).serve(wp, key)
+			return
+		}
+		go wp.manageKeyQueue(key)
+	}
+}
+
+// Warm sets up the given keys and starts their managers ahead of any work, so that the first work submitted for a
+// latency-sensitive key doesn't pay for either.  A warmed manager waits for work for the idle timeout (see
+// WithIdleTimeout) like any other, after which the key goes cold again.  Keys which are already active are left alone.
+// Warm panics like Submit: with ErrPoolClosed if the workpool has been shut down, or with ErrDraining if it is
+// draining and any key isn't tracked
+func (wp *KeyedWorkpool[K]) Warm(keys ...K) {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	for _, key := range keys {
+		if err := wp.accepts(key); err != nil {
+			panic(err)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := wp.notif.Load(key); !ok {
+			wp.setupKey(key)
+		}
+		wp.startManager(key)
+	}
+}
+
+// setupKey creates the state for a key seen for the first time, or for the first time since its manager exited.  The
+// submit mutex must be held, which makes the setup all-or-nothing: retireKey tears the same state down under the same
+// mutex, so no Submit or manager can observe a key which is only partly set up
+func (wp *KeyedWorkpool[K]) setupKey(key K) {
+	wp.debug("workpool: key first seen", key)
+	wp.emit(KeySeen, key)
+	wp.pool.Store(key, wp.newQueue(key))
+	if parallelism, unordered := wp.parallelism(key); unordered {
+		wp.notif.Store(key, newUnorderedLock(parallelism))
+	} else {
+		wp.notif.Store(key, &sync.Mutex{})
+	}
+	wp.ready.Store(key, make(chan struct{}, 1))
+	wp.pending.Store(key, new(int64))
+	wp.isAlive.Store(key, false)
+	atomic.AddInt64(wp.tracked, 1)
+	wp.evictIdle()
+}
+
+// newQueue creates the queue for a key, from the queue factory if there is one
+func (wp *KeyedWorkpool[K]) newQueue(key K) keyQueue[K] {
+	if wp.hooks.queueFactory != nil {
+		return &customQueue[K]{q: wp.hooks.queueFactory(key)}
+	}
+	wq := &workQueue[K]{queue: make([]entry[K], 0), mtx: &sync.Mutex{}, dedupe: wp.cfg.dedupe}
+	wq.lifo = wp.hooks.keyOrdering != nil && wp.hooks.keyOrdering(key) == LIFO
+	if !wq.lifo && !wp.cfg.synchronous {
+		wq.reorder = wp.cfg.reorderWindow
+	}
+	return wq
+}
+
+// QueueLen returns the number of submitted items which have not yet finished, including any that are currently running.
+// The count is decremented just after an item's Do returns, so it may briefly lag behind the actual completion of work:
+// anything a Do signals before returning (such as a WaitGroup) can be observed before QueueLen reflects it.
+func (wp *KeyedWorkpool[K]) QueueLen() uint64 {
+	return atomic.LoadUint64(wp.queueLen)
+}
+
+// NumManagers returns how many keys currently have a management goroutine, including managers which are idle and waiting
+// out the idle timeout.  Every manager exits once its key has been idle for the idle timeout (see WithIdleTimeout), so
+// a workpool left alone for longer than that has none, which tests can use to check for leaked goroutines
+func (wp *KeyedWorkpool[K]) NumManagers() int {
+	return int(atomic.LoadInt64(wp.managers))
+}
+
+// Pause holds the key's queued work until Resume is called.  Work may still be submitted for the key, and queues up in
+// order.  Any item which is already running is allowed to finish.  Pausing a paused key does nothing.
+// Shutdown and Close override a pause, so that the pool can drain
+func (wp *KeyedWorkpool[K]) Pause(key K) {
+	wp.paused.LoadOrStore(key, make(chan struct{}))
+}
+
+// Resume releases the key's queued work, in order, after a Pause.  Resuming a key which isn't paused does nothing
+func (wp *KeyedWorkpool[K]) Resume(key K) {
+	if resumed, ok := wp.paused.LoadAndDelete(key); ok {
+		close(resumed.(chan struct{}))
+	}
+}
+
+// PauseAll holds the queued work of every key until ResumeAll is called, as though every key were paused.  Pausing a
+// paused pool does nothing.  Keys paused with Pause stay paused after ResumeAll.
+// Shutdown and Close override a pause, so that the pool can drain
+func (wp *KeyedWorkpool[K]) PauseAll() {
+	wp.pauseMtx.Lock()
+	defer wp.pauseMtx.Unlock()
+	if atomic.LoadUint32(wp.pausedAll) == 0 {
+		wp.resumeAll = make(chan struct{})
+		atomic.StoreUint32(wp.pausedAll, 1)
+	}
+}
+
+// ResumeAll releases every key's queued work after a PauseAll.  Resuming a pool which isn't paused does nothing
+func (wp *KeyedWorkpool[K]) ResumeAll() {
+	wp.pauseMtx.Lock()
+	defer wp.pauseMtx.Unlock()
+	if atomic.LoadUint32(wp.pausedAll) == 1 {
+		atomic.StoreUint32(wp.pausedAll, 0)
+		close(wp.resumeAll)
+		wp.resumeAll = nil
+	}
+}
+
+// Stats is a point-in-time view of the workpool's gauges and counters.  Each field is read separately, so they may not
+// be mutually consistent while work is in flight.  The counters are useful for tuning WithIdleTimeout: a RespawnCount
+// far above the number of distinct keys means keys are torn down between bursts of work only to be set up again, and
+// a climbing IdleRaces means work often arrives just as the timeout expires
+type Stats struct {
+	// see QueueLen
+	QueueLen uint64
+	// how many keys have a running manager goroutine
+	ActiveKeys int64
+	// how many items are executing right now
+	RunningItems int64
+	// how many keys the workpool is tracking.  A key is tracked from its first submission until its manager exits idle
+	TrackedKeys int64
+	// how many times a manager goroutine has been started, whether for a new key or for one whose manager exited idle.
+	// Counted since New or Reset
+	RespawnCount uint64
+	// how many times a manager found work had arrived just as it was exiting idle, and carried on with it rather than
+	// exiting.  Counted since New or Reset
+	IdleRaces uint64
+	// how many items have waited longer than the threshold given to WithOnStarvation for a slot.  Counted since New or
+	// Reset
+	Starvations uint64
+	// how many items have been dropped because their key was busy (see WithDropWhileBusy).  Counted since New or Reset
+	BusyDrops uint64
+	// how many bytes of SizedWork have been submitted but not yet finished, whether or not WithMaxQueueBytes limits them.
+	// Like WithMaxTotalQueue, running work is counted until it finishes
+	QueuedBytes int64
+	// how many items have finished per second, averaged over the window given to WithThroughputWindow.  Items dropped
+	// without running aren't counted
+	Throughput float64
+}
+
+// Stats returns the workpool's current gauges
+func (wp *KeyedWorkpool[K]) Stats() Stats {
+	return Stats{
+		QueueLen:     atomic.LoadUint64(wp.queueLen),
+		ActiveKeys:   atomic.LoadInt64(wp.managers),
+		RunningItems: atomic.LoadInt64(wp.running),
+		TrackedKeys:  atomic.LoadInt64(wp.tracked),
+		RespawnCount: atomic.LoadUint64(wp.spawns),
+		IdleRaces:    atomic.LoadUint64(wp.idleRaces),
+		Starvations:  atomic.LoadUint64(wp.starvations),
+		BusyDrops:    atomic.LoadUint64(wp.busyDrops),
+		QueuedBytes:  atomic.LoadInt64(wp.queuedBytes),
+		Throughput:   wp.throughput.read(time.Now(), wp.cfg.meterWindow),
+	}
+}
+
+// PurgeKey drops all work queued for the given key which hasn't yet started, and returns how many items were dropped.
+// An item which is already running is allowed to finish.  Unknown keys have nothing to purge
+func (wp *KeyedWorkpool[K]) PurgeKey(key K) int {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+
+	p, ok := wp.pool.Load(key)
+	if !ok {
+		return 0
+	}
+	return len(wp.purgeLocked(key, p.(keyQueue[K])))
+}
+
+// purgeLocked empties the key's queue, finishing each item without running it, and returns the purged entries.  The
+// submit mutex must be held
+func (wp *KeyedWorkpool[K]) purgeLocked(key K, wq keyQueue[K]) []entry[K] {
+	purged := wq.purge()
+	pending, _ := wp.pending.Load(key)
+	// if the manager has already seen the work, it will find the queue empty
+	for _, e := range purged {
+		e.result.complete(ErrWorkDropped)
+		wp.finish(pending.(*int64), e.work)
+	}
+	return purged
+}
+
+// DrainPending shuts down the workpool, and takes every item which hasn't yet started out of its key's queue, so that
+// it can be persisted and resubmitted after a restart, for example with SubmitBatch.  The work is returned grouped by
+// key, with each key's work in the order it would have run.  Work submitted via SubmitContext or SubmitErr is returned
+// wrapped in an adapter to Work.  Items which are already running are left to finish: call Shutdown afterwards to wait
+// for them.  Any subsequent call to Submit panics with ErrPoolClosed.
+// DrainPending must only be called once the caller has stopped submitting work: a concurrent Submit may panic
+func (wp *KeyedWorkpool[K]) DrainPending() []KeyedWork[K] {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+	if atomic.CompareAndSwapUint32(wp.closed, 0, 1) {
+		wp.wakeIdle()
+	}
+
+	var works []KeyedWork[K]
+	wp.pool.Range(func(k, p interface{}) bool {
+		for _, e := range wp.purgeLocked(k.(K), p.(keyQueue[K])) {
+			// a MultiKeyWork is returned once, rather than for each of its keys
+			if _, ok := e.work.(holdWork[K]); !ok {
+				works = append(works, unwrapPart(e.work))
+			}
+		}
+		return true
+	})
+	return works
+}
+
+// Snapshot returns the number of items waiting to run for each tracked key, as KeyQueueLen would.  The snapshot is
+// best-effort: each key is read separately while work continues, so it may be stale or inconsistent across keys by the
+// time it's returned
+func (wp *KeyedWorkpool[K]) Snapshot() map[K]int {
+	snap := map[K]int{}
+	wp.pool.Range(func(k, p interface{}) bool {
+		snap[k.(K)] = p.(keyQueue[K]).len()
+		return true
+	})
+	return snap
+}
+
+// OldestPendingAge returns how long the longest waiting item which hasn't yet started has been queued, across all keys,
+// or 0 if nothing is queued.  It's a health signal which QueueLen can't give: a short queue which has stopped moving.
+// It only looks at the head of each key's queue, which is its oldest item unless PriorityWork has jumped ahead of it.
+// Work in a Queue from WithQueueFactory isn't timestamped, so isn't seen.  Like Snapshot, it's best-effort
+func (wp *KeyedWorkpool[K]) OldestPendingAge() time.Duration {
+	var oldest time.Time
+	wp.pool.Range(func(_, p interface{}) bool {
+		e, ok := p.(keyQueue[K]).peek()
+		if ok && !e.enqueued.IsZero() && (oldest.IsZero() || e.enqueued.Before(oldest)) {
+			oldest = e.enqueued
+		}
+		return true
+	})
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// SnapshotWork returns the work waiting to run for each tracked key, in the order it will run.  Like Snapshot, it is
+// best-effort and may be stale by the time it's returned
+func (wp *KeyedWorkpool[K]) SnapshotWork() map[K][]KeyedWork[K] {
+	snap := map[K][]KeyedWork[K]{}
+	wp.pool.Range(func(k, p interface{}) bool {
+		works := p.(keyQueue[K]).snapshot()
+		for i, w := range works {
+			works[i] = unwrapPart(w)
+		}
+		snap[k.(K)] = works
+		return true
+	})
+	return snap
+}
+
+// PeekKey returns the work which will run next for the given key, without taking it off the queue.  It returns false if
+// the key has no work queued, including when its only work is already running.  Like Snapshot, the answer may be stale
+// by the time it's returned: the key's manager may take the work at any moment.  A Queue from WithQueueFactory can't be
+// peeked into, so always returns false
+func (wp *KeyedWorkpool[K]) PeekKey(key K) (KeyedWork[K], bool) {
+	p, ok := wp.pool.Load(key)
+	if !ok {
+		return nil, false
+	}
+	e, ok := p.(keyQueue[K]).peek()
+	if !ok {
+		return nil, false
+	}
+	return unwrapPart(e.work), true
+}
+
+// ReplaceHead swaps the work which will run next for the given key for w, which runs in its place, and returns true.
+// The replaced work is dropped without running, and any Result for it completes once w has run.  It returns false if
+// the key has no work queued, if w is for another key, if the head is a MultiKeyWork, if w is larger than the head and
+// doesn't fit under WithMaxQueueBytes, or if the key's Queue is from WithQueueFactory.  The head may start running at
+// any moment, so pair ReplaceHead with Pause for a replacement which can't come too late.  It panics with ErrNilWork if w is nil
+func (wp *KeyedWorkpool[K]) ReplaceHead(key K, w KeyedWork[K]) bool {
+	if isNil(w) {
+		panic(ErrNilWork)
+	}
+	if w.Key() != key {
+		return false
+	}
+	p, ok := wp.pool.Load(key)
+	if !ok {
+		return false
+	}
+	return p.(keyQueue[K]).replaceHead(w, func(head KeyedWork[K]) bool {
+		return !isPart(head) && wp.resize(head, w)
+	})
+}
+
+// resize moves the room held under the byte limit by queued work over to the work replacing it, and returns true.  It
+// returns false if the replacement is larger and doesn't fit
+func (wp *KeyedWorkpool[K]) resize(old, w KeyedWork[K]) bool {
+	bytes := wp.size([]KeyedWork[K]{w}) - wp.size([]KeyedWork[K]{old})
+	if wp.byteCapacity != nil {
+		if bytes > 0 && !wp.byteCapacity.TryAcquire(bytes) {
+			return false
+		}
+		if bytes < 0 {
+			wp.byteCapacity.Release(-bytes)
+		}
+	}
+	atomic.AddInt64(wp.queuedBytes, bytes)
+	return true
+}
+
+// Wait blocks until the workpool is idle: all submitted work has finished, and every key's management goroutine has
+// exited.  Wait is only meaningful once the caller has stopped submitting work.  If work is submitted concurrently, Wait
+// may return during a momentary lull between submissions, or may never return if the submissions never let up.
+func (wp *KeyedWorkpool[K]) Wait() {
+	wp.idleMtx.Lock()
+	defer wp.idleMtx.Unlock()
+	for atomic.LoadUint64(wp.queueLen) != 0 || atomic.LoadInt64(wp.managers) != 0 {
+		wp.idleCond.Wait()
+	}
+}
+
+// WaitKey blocks until the given key has no work, either queued or running, and returns nil.  Work submitted for the
+// key while waiting is waited for too.  A key which has no work, including one which has never been seen, returns
+// immediately.  If ctx expires first, its error is returned.
+// A key's work can never see its key idle, since it's still running.  If ctx is the one handed to a ContextWork for the
+// same key, WaitKey returns ErrSelfDeadlock rather than blocking forever.  Other work can't be detected, so must not
+// wait on its own key
+func (wp *KeyedWorkpool[K]) WaitKey(ctx context.Context, key K) error {
+	return wp.WaitKeys(ctx, key)
+}
+
+// WaitKeys is WaitKey for a set of keys: it blocks until none of them has any work at the same time, for example as a
+// barrier across a known set of entities, and returns nil.  Keys which have never been seen have no work.  If ctx
+// expires first, its error is returned, and if ctx is the one handed to a ContextWork for one of the keys, WaitKeys
+// returns ErrSelfDeadlock
+func (wp *KeyedWorkpool[K]) WaitKeys(ctx context.Context, keys ...K) error {
+	if r, ok := ctx.Value(runningKey{}).(running[K]); ok && r.wp == wp && slices.Contains(keys, r.key) {
+		return ErrSelfDeadlock
+	}
+	stop := context.AfterFunc(ctx, wp.signalIdle)
+	defer stop()
+
+	wp.idleMtx.Lock()
+	defer wp.idleMtx.Unlock()
+	for !wp.keysIdle(keys) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wp.idleCond.Wait()
+	}
+	return nil
+}
+
+// keysIdle returns whether none of the keys has any work.  A retired key has none
+func (wp *KeyedWorkpool[K]) keysIdle(keys []K) bool {
+	for _, key := range keys {
+		if p, ok := wp.pending.Load(key); ok && atomic.LoadInt64(p.(*int64)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush blocks until every item submitted for the key before the call has run, including any which is running, so that
+// the caller can checkpoint the key.  Unlike WaitKey, it doesn't wait for work submitted after the call.  Flush queues a
+// marker item behind the key's work and waits for it to run, so the marker is seen like any other item, for example by
+// WithOnComplete.  The marker is queued behind the key's work even on a LIFO key (see WithKeyOrdering).  Queued
+// PriorityWork with a negative priority is behind the marker, so isn't waited for.  A key which has no work returns
+// immediately.  Flush panics like Submit if the workpool has been shut down while the key has work.
+// Work must not flush its own key, which would wait on itself
+func (wp *KeyedWorkpool[K]) Flush(key K) {
+	marker := newResult()
+	w := FromFunc(key, func() {})
+	func() {
+		wp.reserve(w)
+		defer wp.drainSync()
+		wp.submitMtx.Lock()
+		defer wp.submitMtx.Unlock()
+		if p, ok := wp.pending.Load(key); !ok || atomic.LoadInt64(p.(*int64)) == 0 {
+			wp.unreserve(w)
+			marker = nil
+			return
+		}
+		wp.submitLocked(entry[K]{work: w, result: marker, fifo: true, keep: true})
+	}()
+	if marker != nil {
+		marker.Wait()
+	}
+}
+
+// KeyQueueLen returns the number of items waiting to run for the given key.  An item that is currently running is not
+// counted.  Unknown keys have a length of 0
+func (wp *KeyedWorkpool[K]) KeyQueueLen(key K) int {
+	p, ok := wp.pool.Load(key)
+	if !ok {
+		return 0
+	}
+	return p.(keyQueue[K]).len()
+}
+
+// IsActive returns whether the key is being processed: it has work queued or running, or its management goroutine is
+// still lingering for more (see WithIdleTimeout).  The answer is read under the same lock that Submit spawns managers
+// and idle managers retire under, so it's consistent with them, but it may be stale by the time it's returned
+func (wp *KeyedWorkpool[K]) IsActive(key K) bool {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+	isAlive, ok := wp.isAlive.Load(key)
+	return ok && isAlive.(bool)
+}
+
+// Keys returns a snapshot of every key currently tracked by the workpool, in no particular order
+func (wp *KeyedWorkpool[K]) Keys() []K {
+	var keys []K
+	wp.pool.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(K))
+		return true
+	})
+	return keys
+}
+
+// Reset returns the workpool to the state New left it in, so that it can be reused, for example between test cases.
+// Any paused keys are resumed, then Reset blocks until the workpool is idle (see Wait) before clearing the state of
+// every key and zeroing its counters.  Options, and any errors waiting on the Errors channel, are kept.  A workpool
+// which has been shut down stays shut down, but a Drain is forgotten.
+// Reset must only be called once the caller has stopped submitting work: a concurrent Submit may be lost
+func (wp *KeyedWorkpool[K]) Reset() {
+	wp.paused.Range(func(key, _ interface{}) bool {
+		wp.Resume(key.(K))
+		return true
+	})
+	wp.ResumeAll()
+	wp.Wait()
+
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+	for _, m := range []*sync.Map{wp.pool, wp.notif, wp.ready, wp.pending, wp.isAlive, wp.paused, wp.breakers, wp.watermarks, wp.keyRates} {
+		m.Range(func(key, _ interface{}) bool {
+			m.Delete(key)
+			return true
+		})
+	}
+	atomic.StoreUint64(wp.queueLen, 0)
+	atomic.StoreInt64(wp.running, 0)
+	atomic.StoreInt64(wp.tracked, 0)
+	atomic.StoreUint32(wp.draining, 0)
+	wp.ResetMetrics()
+}
+
+// ResetMetrics zeroes the workpool's counters, such as Stats' RespawnCount, and its throughput averages (see
+// WithThroughputWindow), without touching any other state, so that a benchmark can measure the steady state after a
+// warm up.  It's safe to call while work is running.  Gauges of the current state, such as QueueLen and RunningItems,
+// are left alone: the workpool relies on them being accurate
+func (wp *KeyedWorkpool[K]) ResetMetrics() {
+	atomic.StoreUint64(wp.spawns, 0)
+	atomic.StoreUint64(wp.idleRaces, 0)
+	atomic.StoreUint64(wp.starvations, 0)
+	atomic.StoreUint64(wp.busyDrops, 0)
+	wp.throughput.reset()
+	wp.keyRates.Range(func(_, m interface{}) bool {
+		m.(*meter).reset()
+		return true
+	})
+}
+
+// Drain quiesces the workpool gradually, for example ahead of a rolling restart.  Unlike Shutdown, which rejects all new
+// work, Drain only rejects new keys: Submit panics with ErrDraining for a key which isn't already tracked, but more work
+// may still be submitted for keys which are.  Each key is tracked until its queue empties and its management goroutine
+// exits idle, after which it is new again.  Drain blocks until every key has done so, at which point all work is
+// rejected, and the workpool should be shut down.  Drain may never return if work for a tracked key never lets up.
+func (wp *KeyedWorkpool[K]) Drain() {
+	wp.submitMtx.Lock()
+	atomic.StoreUint32(wp.draining, 1)
+	wp.submitMtx.Unlock()
+	wp.Wait()
+}
+
+// Shutdown stops the workpool from accepting new work, and blocks until all previously submitted work has run.
+// Any subsequent call to Submit panics with ErrPoolClosed, as does one blocked on a full workpool, and SubmitOrErr
+// returns it.  Submitting concurrently with Shutdown is safe: each item is either rejected so, or accepted and run
+// before Shutdown returns nil.  Idle per-key goroutines exit as soon as their queues empty.
+// Shutdown returns nil once the pool has drained.  If ctx expires first, a *ShutdownError is returned holding the
+// number of items still outstanding; the remaining work continues to run in the background unless Close is called.
+// It is safe to call Shutdown more than once, for example to wait again after a timeout.
+func (wp *KeyedWorkpool[K]) Shutdown(ctx context.Context) error {
+	wp.submitMtx.Lock()
+	if atomic.CompareAndSwapUint32(wp.closed, 0, 1) {
+		wp.wakeIdle()
+	}
+	wp.submitMtx.Unlock()
+
+	// the closed flag is set before this check, so if work is still outstanding the last item to finish will see it
+	if atomic.LoadUint64(wp.queueLen) == 0 {
+		wp.markDrained()
+		return nil
+	}
+	select {
+	case <-wp.drained:
+		return nil
+	case <-ctx.Done():
+		return &ShutdownError{Remaining: atomic.LoadUint64(wp.queueLen), Err: ctx.Err()}
+	}
+}
+
+// Close immediately stops the workpool.  Any subsequent call to Submit panics with ErrPoolClosed, queued work which
+// has not yet started is dropped, and the context handed to ContextWork is cancelled.  Close does not wait for running
+// work to return: call Shutdown afterwards to wait for it.
+func (wp *KeyedWorkpool[K]) Close() {
+	wp.submitMtx.Lock()
+	defer wp.submitMtx.Unlock()
+	atomic.StoreUint32(wp.closed, 1)
+	wp.cancel()
 }
@@ -1,12 +1,20 @@
 package workpool
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"log/slog"
 	"math"
 	"math/rand"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type wrk struct {
@@ -119,6 +127,23 @@ func (s *system) newWorkForKey(wg *sync.WaitGroup, k string) ([]Work, int) {
 	return w, v
 }
 
+// assertDrained waits for the queue length to catch up with the work having run
+func assertDrained(t *testing.T, wp *Workpool) {
+	assert.Eventually(t, func() bool { return wp.QueueLen() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestQueueLen(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "key", d: func() { <-block }})
+	}
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+	assert.Equal(t, uint64(4), sut.QueueLen())
+	close(block)
+	assertDrained(t, sut)
+}
+
 func TestSingleUnique(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -126,7 +151,7 @@ func TestSingleUnique(t *testing.T) {
 	ntw := newRandomTestWork(&wg)
 	sut.Submit(ntw)
 	wg.Wait()
-	//assert.Equal(t, uint64(0), *sut.queueLen)
+	assertDrained(t, sut)
 }
 
 func TestDoubleUnique(t *testing.T) {
@@ -136,7 +161,7 @@ func TestDoubleUnique(t *testing.T) {
 	sut.Submit(newRandomTestWork(&wg))
 	sut.Submit(newRandomTestWork(&wg))
 	wg.Wait()
-	//assert.Equal(t, uint64(0), *sut.queueLen)
+	assertDrained(t, sut)
 }
 
 func TestManyUnique(t *testing.T) {
@@ -148,7 +173,7 @@ func TestManyUnique(t *testing.T) {
 		sut.Submit(newRandomTestWork(&wg))
 	}
 	wg.Wait()
-	//assert.Equal(t, uint64(0), *sut.queueLen)
+	assertDrained(t, sut)
 }
 
 func BenchmarkManyUnique(b *testing.B) {
@@ -161,6 +186,66 @@ func BenchmarkManyUnique(b *testing.B) {
 	wg.Wait()
 }
 
+func TestNumManagers(t *testing.T) {
+	sut := New(WithIdleTimeout(5 * time.Millisecond))
+	assert.Equal(t, 0, sut.NumManagers())
+	before := runtime.NumGoroutine()
+	block := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		sut.Submit(wrk{k: strconv.Itoa(i), d: func() { <-block }})
+	}
+	assert.Equal(t, 10, sut.NumManagers())
+	close(block)
+
+	// past the idle timeout, every manager has exited
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, sut.NumManagers())
+	// not assert.Eventually, whose own goroutines would be counted
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+// calledBy returns whether its caller was called, however indirectly, by the named function, such as "manageKeyQueue"
+func calledBy(name string) bool {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasSuffix(frame.Function, "."+name) {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+func TestGoroutinePerKey(t *testing.T) {
+	sut := New()
+	const keys = 100
+	block := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(keys)
+	var inManager int32
+	for i := 0; i < keys; i++ {
+		sut.Submit(wrk{k: strconv.Itoa(i), d: func() {
+			// each key's work runs in its manager, rather than in a goroutine of its own
+			if calledBy("manageKeyQueue") {
+				atomic.AddInt32(&inManager, 1)
+			}
+			started.Done()
+			<-block
+		}})
+	}
+	started.Wait()
+	assert.Equal(t, keys, sut.NumManagers())
+	close(block)
+	sut.Wait()
+	assert.Equal(t, int32(keys), atomic.LoadInt32(&inManager))
+}
+
 func TestDuplicate(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(7 * 2)
@@ -178,7 +263,7 @@ func TestDuplicate(t *testing.T) {
 	wg.Wait()
 	assert.Equal(t, expected1, s.getValue("key1"))
 	assert.Equal(t, expected2, s.getValue("key2"))
-	//assert.Equal(t, uint64(0), *sut.queueLen)
+	assertDrained(t, sut)
 }
 
 func TestManyDuplicate(t *testing.T) {
@@ -204,6 +289,63 @@ func TestManyDuplicate(t *testing.T) {
 
 }
 
+// reentryGuard panics if it's entered while already held, which for a key's work means two items ran concurrently
+type reentryGuard struct {
+	held int32
+}
+
+func (g *reentryGuard) enter() {
+	if !atomic.CompareAndSwapInt32(&g.held, 0, 1) {
+		panic("work for the key ran concurrently")
+	}
+}
+
+func (g *reentryGuard) exit() {
+	atomic.StoreInt32(&g.held, 0)
+}
+
+func TestStrictSerialization(t *testing.T) {
+	var panics int32
+	sut := New(WithPanicHandler(func(w Work, recovered interface{}, _ []byte) {
+		atomic.AddInt32(&panics, 1)
+		t.Errorf("key %s: %v", w.Key(), recovered)
+	}))
+	const submitters, keys, perKey = 8, 50, 100
+	var guards [keys]reentryGuard
+	// each submitter's items for a key must run in the order it submitted them
+	var ran [keys][submitters][]int
+	var wg sync.WaitGroup
+	for s := 0; s < submitters; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perKey; i++ {
+				for k := 0; k < keys; k++ {
+					sut.Submit(wrk{k: strconv.Itoa(k), d: func() {
+						guards[k].enter()
+						defer guards[k].exit()
+						ran[k][s] = append(ran[k][s], i)
+						runtime.Gosched()
+					}})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sut.Wait()
+
+	assert.Zero(t, atomic.LoadInt32(&panics))
+	for k := range ran {
+		for s := range ran[k] {
+			if assert.Len(t, ran[k][s], perKey, "key %d submitter %d lost work", k, s) {
+				for i, v := range ran[k][s] {
+					assert.Equal(t, i, v, "key %d submitter %d ran out of order", k, s)
+				}
+			}
+		}
+	}
+}
+
 func BenchmarkManyDuplicate(b *testing.B) {
 	wg := sync.WaitGroup{}
 	wg.Add(7 * b.N)
@@ -218,3 +360,1445 @@ func BenchmarkManyDuplicate(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestSubmitBatch(t *testing.T) {
+	sut := New()
+	var ran []int
+	var others int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for b := 0; b < 2; b++ {
+		batch := make([]Work, 0, 100)
+		for i := 0; i < 50; i++ {
+			batch = append(batch, wrk{k: "key", d: func() { ran = append(ran, b) }})
+			batch = append(batch, wrk{k: strconv.Itoa(b), d: func() { atomic.AddInt32(&others, 1) }})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			sut.SubmitBatch(batch)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	sut.Wait()
+
+	assert.Equal(t, int32(100), atomic.LoadInt32(&others))
+	if assert.Len(t, ran, 100) {
+		assert.NotEqual(t, ran[0], ran[50])
+		for i := range ran {
+			assert.Equal(t, ran[i/50*50], ran[i], "batches interleaved at %d", i)
+		}
+	}
+
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.PanicsWithValue(t, ErrPoolClosed, func() {
+		sut.SubmitBatch([]Work{wrk{k: "key", d: func() {}}})
+	})
+	assert.Equal(t, uint64(0), sut.QueueLen())
+}
+
+func TestInvalidWork(t *testing.T) {
+	sut := New(WithMaxTotalQueue(1))
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.Submit(nil) })
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.TrySubmit(nil) })
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.SubmitErr(nil) })
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.SubmitContext(nil) })
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.SubmitBatch([]Work{nil}) })
+	assert.PanicsWithValue(t, ErrEmptyKey, func() { sut.Submit(wrk{k: "", d: func() {}}) })
+	assert.PanicsWithValue(t, ErrEmptyKey, func() { sut.Warm("") })
+
+	// nothing was left holding the pool's capacity
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	assert.True(t, sut.TrySubmit(wrk{k: "key", d: func() {}}))
+	sut.Wait()
+
+	// other types of key have no empty key
+	ints := NewKeyed[int]()
+	ints.SubmitFunc(0, func() {})
+	ints.Wait()
+}
+
+func TestSubmitOrErr(t *testing.T) {
+	sut := New(WithMaxQueueDepth(1), WithMaxTotalQueue(3))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, sut.SubmitOrErr(wrk{k: "a", d: func() {
+		close(started)
+		<-block
+	}}))
+	<-started
+	assert.NoError(t, sut.SubmitOrErr(wrk{k: "a", d: func() {}}))
+	// a's queue is as deep as allowed
+	assert.ErrorIs(t, sut.SubmitOrErr(wrk{k: "a", d: func() {}}), ErrQueueFull)
+	assert.NoError(t, sut.SubmitOrErr(wrk{k: "b", d: func() { <-block }}))
+	// and now the pool is full
+	assert.ErrorIs(t, sut.SubmitOrErr(wrk{k: "c", d: func() {}}), ErrQueueFull)
+	close(block)
+	sut.Wait()
+
+	sut.Pause("a")
+	assert.ErrorIs(t, sut.SubmitOrErr(wrk{k: "a", d: func() {}}), ErrPaused)
+	sut.Resume("a")
+	sut.PauseAll()
+	assert.ErrorIs(t, sut.SubmitOrErr(wrk{k: "b", d: func() {}}), ErrPaused)
+	sut.ResumeAll()
+	assert.ErrorIs(t, sut.SubmitOrErr(nil), ErrNilWork)
+	assert.Equal(t, uint64(0), sut.QueueLen())
+
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.ErrorIs(t, sut.SubmitOrErr(wrk{k: "a", d: func() {}}), ErrPoolClosed)
+}
+
+func TestSubmitDuringShutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+	sut := New(WithMaxTotalQueue(10), WithIdleTimeout(time.Minute))
+	var accepted, ran int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(orErr bool) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				w := wrk{k: strconv.Itoa(n % 20), d: func() { atomic.AddInt64(&ran, 1) }}
+				if orErr {
+					if err := sut.SubmitOrErr(w); errors.Is(err, ErrPoolClosed) {
+						return
+					} else if err == nil {
+						atomic.AddInt64(&accepted, 1)
+					}
+					continue
+				}
+				// Submit either accepts the work or panics, even while it's blocked on the full pool
+				submitted := func() bool {
+					defer func() {
+						if r := recover(); r != nil {
+							assert.Equal(t, ErrPoolClosed, r)
+						}
+					}()
+					sut.Submit(w)
+					return true
+				}()
+				if !submitted {
+					return
+				}
+				atomic.AddInt64(&accepted, 1)
+			}
+		}(i%2 == 0)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	wg.Wait()
+
+	// nothing accepted was lost
+	assert.Greater(t, atomic.LoadInt64(&accepted), int64(0))
+	assert.Equal(t, atomic.LoadInt64(&accepted), atomic.LoadInt64(&ran))
+	// and nothing was left behind, despite the long idle timeout
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	N := 100
+	wg := sync.WaitGroup{}
+	wg.Add(7 * N)
+	sut := New()
+	s := newSystem()
+	var expecteds []int
+
+	for i := 0; i < N; i++ {
+		w, exp := s.newWorkForKey(&wg, strconv.Itoa(i))
+		expecteds = append(expecteds, exp)
+		for _, unit := range w {
+			sut.Submit(unit)
+		}
+	}
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	for i := 0; i < N; i++ {
+		assert.Equal(t, expecteds[i], s.getValue(strconv.Itoa(i)))
+	}
+	assert.Equal(t, uint64(0), sut.QueueLen())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "key", d: func() { <-block }})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := sut.Shutdown(ctx)
+	var se *ShutdownError
+	if assert.True(t, errors.As(err, &se)) {
+		assert.Equal(t, uint64(3), se.Remaining)
+	}
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// the remaining work still runs, and a second Shutdown waits for it
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestSubmitAfterShutdown(t *testing.T) {
+	sut := New()
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.PanicsWithValue(t, ErrPoolClosed, func() {
+		sut.Submit(wrk{k: "key", d: func() {}})
+	})
+}
+
+func TestDrain(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []int
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, 1) }})
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sut.Drain()
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(sut.draining) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.PanicsWithValue(t, ErrDraining, func() { sut.Submit(wrk{k: "new", d: func() {}}) })
+	assert.PanicsWithValue(t, ErrDraining, func() {
+		sut.SubmitBatch([]Work{wrk{k: "key", d: func() {}}, wrk{k: "new", d: func() {}}})
+	})
+	// existing keys may still take more work
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, 2) }})
+	select {
+	case <-drained:
+		t.Fatal("Drain returned before the key's work finished")
+	default:
+	}
+
+	close(block)
+	<-drained
+	assert.Equal(t, []int{1, 2}, ran)
+	assert.Empty(t, sut.Keys())
+	// once the key has gone idle, it's new again
+	assert.PanicsWithValue(t, ErrDraining, func() { sut.Submit(wrk{k: "key", d: func() {}}) })
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestReset(t *testing.T) {
+	sut := New()
+	s := newSystem()
+	wg := sync.WaitGroup{}
+	w, expected := s.newWorkForKey(&wg, "key")
+	wg.Add(len(w))
+	sut.Pause("paused")
+	sut.Submit(wrk{k: "paused", d: func() {}})
+	sut.SubmitBatch(w)
+	sut.Reset()
+
+	assert.Equal(t, expected, s.getValue("key"))
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	assert.Equal(t, Stats{}, sut.Stats())
+	for _, m := range []*sync.Map{sut.pool, sut.notif, sut.ready, sut.isAlive, sut.paused} {
+		assert.Zero(t, mapLen(m))
+	}
+
+	// the pool is as good as new
+	done := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { close(done) }})
+	<-done
+}
+
+func TestShutdownStopsManagers(t *testing.T) {
+	wg := sync.WaitGroup{}
+	wg.Add(10)
+	sut := New()
+	for i := 0; i < 10; i++ {
+		sut.Submit(newRandomTestWork(&wg))
+	}
+	wg.Wait()
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	// idle managers are woken by the shutdown rather than waiting out their timeout
+	assert.Eventually(t, func() bool {
+		alive := false
+		sut.isAlive.Range(func(_, v interface{}) bool {
+			alive = alive || v.(bool)
+			return true
+		})
+		return !alive
+	}, 50*time.Millisecond, time.Millisecond)
+}
+
+func TestPanicDoesNotWedgeKey(t *testing.T) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	type panicked struct {
+		key   string
+		r     interface{}
+		stack string
+	}
+	panics := make(chan panicked, 1)
+	sut := New(WithPanicHandler(func(w Work, r interface{}, stack []byte) {
+		panics <- panicked{key: w.Key(), r: r, stack: string(stack)}
+	}))
+
+	var ran []int
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, 1) }})
+	sut.Submit(wrk{k: "key", d: func() { panic("boom") }})
+	sut.Submit(wrk{k: "key", d: func() {
+		ran = append(ran, 3)
+		wg.Done()
+	}})
+	wg.Wait()
+
+	assert.Equal(t, []int{1, 3}, ran)
+	p := <-panics
+	assert.Equal(t, "key", p.key)
+	assert.Equal(t, "boom", p.r)
+	// the stack leads to the panicking Do
+	assert.Contains(t, p.stack, "TestPanicDoesNotWedgeKey.func")
+	assert.NoError(t, sut.Shutdown(context.Background()))
+}
+
+func TestKeyQueueLen(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "key", d: func() { <-block }})
+	}
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+
+	// one item per key is running, and not counted
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("key") == 2 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("other") == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, sut.KeyQueueLen("unknown"))
+	assert.ElementsMatch(t, []string{"key", "other"}, sut.Keys())
+	close(block)
+	assertDrained(t, sut)
+}
+
+// mapLen counts the entries in the given map
+func mapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// TestSubmitRacingIdleManager hammers a few keys with an idle timeout short enough that their managers are constantly
+// exiting and being respawned, racing Submit.  Run it with -race: no item may be lost, run twice, or run out of order
+func TestSubmitRacingIdleManager(t *testing.T) {
+	sut := New(WithIdleTimeout(time.Microsecond))
+	const submitters, keys, perKey = 4, 4, 500
+	var ran [submitters][keys][]int
+	var wg sync.WaitGroup
+	for s := 0; s < submitters; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perKey; i++ {
+				for k := 0; k < keys; k++ {
+					// every submitter shares the key, so the key's lock orders the appends
+					sut.Submit(wrk{k: strconv.Itoa(k), d: func() { ran[s][k] = append(ran[s][k], i) }})
+				}
+				if i%50 == 0 {
+					// let the managers go idle
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sut.Wait()
+
+	for s := range ran {
+		for k := range ran[s] {
+			if assert.Len(t, ran[s][k], perKey, "submitter %d key %d", s, k) {
+				for i, v := range ran[s][k] {
+					assert.Equal(t, i, v, "submitter %d key %d ran out of order", s, k)
+				}
+			}
+		}
+	}
+	assertDrained(t, sut)
+}
+
+func TestConcurrentFirstSubmit(t *testing.T) {
+	var buf bytes.Buffer
+	// the handler serializes its writes
+	sut := New(WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	var ran int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			sut.Submit(wrk{k: "new", d: func() { atomic.AddInt32(&ran, 1) }})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	// wait for the manager to exit too, so that the log is quiet
+	sut.Wait()
+
+	assert.Equal(t, int32(100), atomic.LoadInt32(&ran))
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte(`msg="workpool: key first seen"`)))
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte(`msg="workpool: manager started"`)))
+}
+
+func TestWaitKey(t *testing.T) {
+	sut := New()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, sut.WaitKey(ctx, "never seen"))
+
+	var ran []string
+	sut.Submit(wrk{k: "key", d: func() {
+		time.Sleep(50 * time.Millisecond)
+		ran = append(ran, "blocked")
+		// work arriving during the wait is waited for too
+		sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "follow-up") }})
+	}})
+	// other keys aren't waited for
+	block := make(chan struct{})
+	defer close(block)
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+
+	start := time.Now()
+	assert.NoError(t, sut.WaitKey(ctx, "key"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, []string{"blocked", "follow-up"}, ran)
+
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sut.WaitKey(short, "other"), context.DeadlineExceeded)
+}
+
+func TestWaitKeys(t *testing.T) {
+	sut := New()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, sut.WaitKeys(ctx, "never seen", "nor this"))
+
+	var mtx sync.Mutex
+	var done []string
+	for i, key := range []string{"slow", "fast", "medium"} {
+		delay := []time.Duration{60, 10, 30}[i] * time.Millisecond
+		sut.Submit(wrk{k: key, d: func() {
+			time.Sleep(delay)
+			mtx.Lock()
+			defer mtx.Unlock()
+			done = append(done, key)
+		}})
+	}
+	block := make(chan struct{})
+	defer close(block)
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+
+	assert.NoError(t, sut.WaitKeys(ctx, "slow", "fast", "medium", "never seen"))
+	mtx.Lock()
+	assert.Equal(t, []string{"fast", "medium", "slow"}, done)
+	mtx.Unlock()
+
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sut.WaitKeys(short, "slow", "other"), context.DeadlineExceeded)
+}
+
+func TestSelfSubmit(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Second} {
+		sut := New(WithWorkTimeout(timeout))
+		var ran []string
+		var waitErr, otherErr error
+		sut.SubmitContext(ctxWrk{k: "key", d: func(ctx context.Context) {
+			sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "follow-up") }})
+			// the follow-up can't run until this returns, so waiting on it is refused rather than deadlocking
+			waitErr = sut.WaitKey(ctx, "key")
+			otherErr = sut.WaitKey(ctx, "other")
+			ran = append(ran, "first")
+		}})
+		sut.Wait()
+		assert.ErrorIs(t, waitErr, ErrSelfDeadlock)
+		assert.NoError(t, otherErr)
+		assert.Equal(t, []string{"first", "follow-up"}, ran)
+	}
+}
+
+func TestIsActive(t *testing.T) {
+	sut := New(WithIdleTimeout(10 * time.Millisecond))
+	assert.False(t, sut.IsActive("key"))
+	block := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+	assert.True(t, sut.IsActive("key"))
+	assert.False(t, sut.IsActive("other"))
+
+	close(block)
+	sut.Wait()
+	assert.False(t, sut.IsActive("key"))
+}
+
+func TestIdleKeysAreCleanedUp(t *testing.T) {
+	N := 1000
+	wg := sync.WaitGroup{}
+	wg.Add(N)
+	sut := New()
+	for i := 0; i < N; i++ {
+		sut.Submit(newRandomTestWork(&wg))
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		return mapLen(sut.pool) == 0 && mapLen(sut.notif) == 0 && mapLen(sut.ready) == 0 && mapLen(sut.isAlive) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, sut.Keys())
+
+	// a cleaned up key works as if it were brand new
+	wg.Add(1)
+	sut.Submit(wrk{k: "key", d: wg.Done})
+	wg.Wait()
+	wg.Add(1)
+	time.Sleep(200 * time.Millisecond)
+	sut.Submit(wrk{k: "key", d: wg.Done})
+	wg.Wait()
+}
+
+// childCountingCtx counts the contexts derived from it which have not yet been cancelled.
+// Value hides the wrapped context from the context package, so that children register through AfterFunc
+type childCountingCtx struct {
+	context.Context
+	live int64
+}
+
+func (c *childCountingCtx) Value(interface{}) interface{} {
+	return nil
+}
+
+func (c *childCountingCtx) AfterFunc(f func()) func() bool {
+	atomic.AddInt64(&c.live, 1)
+	stop := context.AfterFunc(c.Context, f)
+	return func() bool {
+		atomic.AddInt64(&c.live, -1)
+		return stop()
+	}
+}
+
+func TestHotKeyReleasesDeadlines(t *testing.T) {
+	sut := New()
+	ctx := &childCountingCtx{Context: sut.idleCtx}
+	sut.idleCtx = ctx
+
+	wg := sync.WaitGroup{}
+	for start := time.Now(); time.Since(start) < time.Second; {
+		wg.Add(1)
+		sut.Submit(wrk{k: "key", d: wg.Done})
+		wg.Wait()
+	}
+	// only the manager's current wait for work may still be pending
+	assert.LessOrEqual(t, atomic.LoadInt64(&ctx.live), int64(1))
+}
+
+func TestSubmitFunc(t *testing.T) {
+	wg := sync.WaitGroup{}
+	wg.Add(3)
+	sut := New()
+	var ran []int
+	for i := 0; i < 3; i++ {
+		i := i
+		sut.SubmitFunc("key", func() {
+			ran = append(ran, i)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2}, ran)
+}
+
+func TestFromFunc(t *testing.T) {
+	// stands in for a type which can't be given methods
+	type event struct {
+		account string
+	}
+	var handled []Work
+	sut := New(WithPanicHandler(func(w Work, recovered interface{}, _ []byte) {
+		handled = append(handled, w)
+	}))
+	var ran []string
+	for _, ev := range []event{{account: "a"}, {account: "a"}} {
+		w := FromFunc(ev.account, func() { ran = append(ran, ev.account) })
+		assert.Equal(t, "a", w.Key())
+		sut.Submit(w)
+	}
+	sut.SubmitFunc("a", func() { panic("boom") })
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, []string{"a", "a"}, ran)
+	if assert.Len(t, handled, 1) {
+		assert.IsType(t, FuncWork{}, handled[0])
+	}
+}
+
+func TestSubmitCtx(t *testing.T) {
+	sut := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []string
+	sut.SubmitCtx(ctx, wrk{k: "key", d: func() {
+		close(started)
+		<-block
+		ran = append(ran, "started")
+	}})
+	<-started
+	sut.SubmitCtx(ctx, wrk{k: "key", d: func() { ran = append(ran, "cancelled") }})
+	sut.SubmitCtx(context.Background(), wrk{k: "key", d: func() { ran = append(ran, "live") }})
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "unscoped") }})
+	cancel()
+	close(block)
+	sut.Wait()
+
+	assert.Equal(t, []string{"started", "live", "unscoped"}, ran)
+	assert.Equal(t, uint64(0), sut.QueueLen())
+}
+
+type ctxWrk struct {
+	k string
+	d func(ctx context.Context)
+}
+
+func (w ctxWrk) Key() string {
+	return w.k
+}
+
+func (w ctxWrk) Do(ctx context.Context) {
+	w.d(ctx)
+}
+
+func TestSubmitContext(t *testing.T) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	sut := New()
+	sut.SubmitContext(ctxWrk{k: "key", d: func(ctx context.Context) {
+		assert.NoError(t, ctx.Err())
+		wg.Done()
+	}})
+	wg.Wait()
+}
+
+func TestCloseCancelsAndDrops(t *testing.T) {
+	sut := New()
+	started := make(chan struct{})
+	var ran int32
+	sut.SubmitContext(ctxWrk{k: "key", d: func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+	}})
+	for i := 0; i < 3; i++ {
+		sut.SubmitContext(ctxWrk{k: "key", d: func(ctx context.Context) {
+			atomic.AddInt32(&ran, 1)
+		}})
+		sut.Submit(wrk{k: "key", d: func() {
+			atomic.AddInt32(&ran, 1)
+		}})
+	}
+	<-started
+
+	sut.Close()
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ran))
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	assert.PanicsWithValue(t, ErrPoolClosed, func() {
+		sut.Submit(wrk{k: "key", d: func() {}})
+	})
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// long enough that only the context can explain the managers exiting
+	sut := NewWithContext(ctx, WithIdleTimeout(time.Minute))
+	started := make(chan struct{})
+	block := make(chan struct{})
+	var ran int32
+	sut.Submit(wrk{k: "idle", d: func() {}})
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	for i := 0; i < 3; i++ {
+		sut.Submit(wrk{k: "key", d: func() { atomic.AddInt32(&ran, 1) }})
+	}
+	<-started
+	assert.Equal(t, int64(2), sut.Stats().ActiveKeys)
+
+	cancel()
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Eventually(t, func() bool { return sut.Stats().ActiveKeys == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ran))
+	assert.PanicsWithValue(t, ErrPoolClosed, func() {
+		sut.Submit(wrk{k: "key", d: func() {}})
+	})
+}
+
+type errWrk struct {
+	k string
+	d func() error
+}
+
+func (w errWrk) Key() string {
+	return w.k
+}
+
+func (w errWrk) Do() error {
+	return w.d()
+}
+
+func TestErrors(t *testing.T) {
+	sut := New()
+	boom := errors.New("boom")
+	sut.SubmitErr(errWrk{k: "a", d: func() error { return nil }})
+	sut.SubmitErr(errWrk{k: "b", d: func() error { return boom }})
+	sut.SubmitErr(errWrk{k: "c", d: func() error { return nil }})
+	assert.NoError(t, sut.Shutdown(context.Background()))
+
+	var errs []KeyError
+	for err := range sut.Errors() {
+		errs = append(errs, err)
+	}
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "b", errs[0].Key)
+		assert.True(t, errors.Is(errs[0], boom))
+	}
+}
+
+func TestWait(t *testing.T) {
+	N := 100
+	sut := New()
+	s := newSystem()
+	wg := sync.WaitGroup{}
+	wg.Add(7 * N)
+	var expecteds []int
+
+	for i := 0; i < N; i++ {
+		w, exp := s.newWorkForKey(&wg, strconv.Itoa(i))
+		expecteds = append(expecteds, exp)
+		for _, unit := range w {
+			sut.Submit(unit)
+		}
+	}
+	sut.Wait()
+	for i := 0; i < N; i++ {
+		assert.Equal(t, expecteds[i], s.getValue(strconv.Itoa(i)))
+	}
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	assert.Empty(t, sut.Keys())
+
+	// an idle pool doesn't block
+	sut.Wait()
+}
+
+type priorityWrk struct {
+	wrk
+	p int
+}
+
+func (w priorityWrk) Priority() int {
+	return w.p
+}
+
+func TestPriority(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+
+	var ran []string
+	record := func(name string) func() {
+		return func() { ran = append(ran, name) }
+	}
+	sut.Submit(wrk{k: "key", d: record("update1")})
+	sut.Submit(priorityWrk{wrk: wrk{k: "key", d: record("update2")}, p: 0})
+	sut.Submit(priorityWrk{wrk: wrk{k: "key", d: record("low")}, p: -1})
+	sut.Submit(wrk{k: "key", d: record("update3")})
+	sut.Submit(priorityWrk{wrk: wrk{k: "key", d: record("cancel1")}, p: 5})
+	sut.Submit(priorityWrk{wrk: wrk{k: "key", d: record("cancel2")}, p: 5})
+	close(block)
+
+	sut.Wait()
+	assert.Equal(t, []string{"cancel1", "cancel2", "update1", "update2", "update3", "low"}, ran)
+}
+
+type delayedWrk struct {
+	wrk
+	nb time.Time
+}
+
+func (w delayedWrk) NotBefore() time.Time {
+	return w.nb
+}
+
+func TestDelayedWork(t *testing.T) {
+	sut := New()
+	start := time.Now()
+	var ranAt sync.Map
+	record := func(name string) func() {
+		return func() { ranAt.Store(name, time.Since(start)) }
+	}
+	sut.Submit(delayedWrk{wrk: wrk{k: "a", d: record("delayed")}, nb: start.Add(100 * time.Millisecond)})
+	sut.Submit(wrk{k: "a", d: record("behind delayed")})
+	sut.Submit(delayedWrk{wrk: wrk{k: "b", d: record("past")}, nb: start.Add(-time.Hour)})
+	sut.Submit(delayedWrk{wrk: wrk{k: "b", d: record("zero")}})
+	sut.Wait()
+
+	at := func(name string) time.Duration {
+		v, ok := ranAt.Load(name)
+		assert.True(t, ok, name)
+		return v.(time.Duration)
+	}
+	assert.GreaterOrEqual(t, at("delayed"), 100*time.Millisecond)
+	assert.GreaterOrEqual(t, at("behind delayed"), at("delayed"))
+	// another key isn't held up by the delay
+	assert.Less(t, at("past"), 100*time.Millisecond)
+	assert.Less(t, at("zero"), 100*time.Millisecond)
+}
+
+func TestSubmitValue(t *testing.T) {
+	sut := New(WithPanicHandler(func(Work, interface{}, []byte) {}))
+	var order []string
+	ints := SubmitValue(sut, "key", func() int {
+		order = append(order, "int")
+		return 42
+	})
+	strs := SubmitValue(sut, "key", func() string {
+		order = append(order, "string")
+		return "hello"
+	})
+	panics := SubmitValue(sut, "key", func() bool {
+		panic("boom")
+	})
+
+	assert.Equal(t, "hello", <-strs)
+	assert.Equal(t, 42, <-ints)
+	_, ok := <-panics
+	assert.False(t, ok)
+	assert.Equal(t, []string{"int", "string"}, order)
+}
+
+func TestSubmitStream(t *testing.T) {
+	sut := New(WithPanicHandler(func(Work, interface{}, []byte) {}))
+	var fns []func() int
+	for i := 0; i < 10; i++ {
+		fns = append(fns, func() int {
+			if i == 5 {
+				panic("boom")
+			}
+			// earlier items are slower, which would reorder them if they ran in parallel
+			time.Sleep(time.Duration(10-i) * time.Millisecond)
+			return i
+		})
+	}
+	stream := SubmitStream(sut, "key", fns)
+	var got []int
+	for v := range stream {
+		got = append(got, v)
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 6, 7, 8, 9}, got)
+
+	_, ok := <-SubmitStream[int](sut, "key", nil)
+	assert.False(t, ok)
+}
+
+func TestDrainPending(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []string
+	sut.Submit(wrk{k: "a", d: func() {
+		close(started)
+		<-block
+		ran = append(ran, "running")
+	}})
+	<-started
+	names := map[Work]string{}
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			name := key + strconv.Itoa(i)
+			w := &wrk{k: key, d: func() { ran = append(ran, name) }}
+			names[w] = name
+			sut.Submit(w)
+		}
+	}
+
+	var drained []string
+	for _, w := range sut.DrainPending() {
+		drained = append(drained, names[w])
+	}
+	// the keys may come in any order, but each key's work is in order
+	if assert.Len(t, drained, 6) && drained[0] == "b0" {
+		drained = append(drained[3:], drained[:3]...)
+	}
+	assert.Equal(t, []string{"a0", "a1", "a2", "b0", "b1", "b2"}, drained)
+	assert.PanicsWithValue(t, ErrPoolClosed, func() { sut.Submit(wrk{k: "a", d: func() {}}) })
+
+	// the running item is left to finish
+	close(block)
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.Equal(t, []string{"running"}, ran)
+}
+
+func TestSnapshot(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "a", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	b := wrk{k: "a", d: func() {}}
+	c := priorityWrk{wrk: wrk{k: "a", d: func() {}}, p: 1}
+	sut.Submit(b)
+	sut.Submit(c)
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]int{"a": 2, "other": 0}, sut.Snapshot())
+	}, time.Second, time.Millisecond)
+	snap := sut.SnapshotWork()
+	assert.Len(t, snap, 2)
+	if assert.Len(t, snap["a"], 2) {
+		assert.Equal(t, "a", snap["a"][0].Key())
+		assert.IsType(t, priorityWrk{}, snap["a"][0])
+		assert.IsType(t, wrk{}, snap["a"][1])
+	}
+	assert.Empty(t, snap["other"])
+	close(block)
+	sut.Wait()
+	assert.Empty(t, sut.Snapshot())
+}
+
+type idempotentWrk struct {
+	wrk
+	id string
+}
+
+func (w idempotentWrk) IdempotencyKey() string {
+	return w.id
+}
+
+func TestIdempotentWork(t *testing.T) {
+	sut := New()
+	var calls int32
+	block := make(chan struct{})
+	started := make(chan struct{})
+	op := func(id string) idempotentWrk {
+		return idempotentWrk{wrk: wrk{k: "key", d: func() {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+				<-block
+			}
+		}}, id: id}
+	}
+	sut.Submit(op("op"))
+	<-started
+
+	duplicate := sut.SubmitResult(op("op"))
+	assert.ErrorIs(t, duplicate.Err(), ErrWorkDropped)
+	// other operations still run
+	other := sut.SubmitResult(op("other"))
+	close(block)
+	other.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// once it's finished, it may run again
+	sut.Submit(op("op"))
+	sut.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, uint64(0), sut.QueueLen())
+}
+
+func TestFlush(t *testing.T) {
+	sut := New()
+	// nothing to flush
+	sut.Flush("key")
+
+	var ran []string
+	a := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() {
+		<-a
+		ran = append(ran, "a")
+	}})
+	sut.Submit(wrk{k: "key", d: func() { ran = append(ran, "b") }})
+	flushed := make(chan struct{})
+	go func() {
+		sut.Flush("key")
+		close(flushed)
+	}()
+	// b and the marker are queued behind a
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("key") == 2 }, time.Second, time.Millisecond)
+
+	c := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() {
+		<-c
+		ran = append(ran, "c")
+	}})
+	select {
+	case <-flushed:
+		t.Fatal("flushed before the queued work ran")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(a)
+	// c is still blocked, so Flush can't be waiting for it
+	<-flushed
+	assert.Equal(t, []string{"a", "b"}, ran)
+	close(c)
+	sut.Wait()
+}
+
+func TestWithSameOptions(t *testing.T) {
+	var completed int32
+	parent := New(WithIdleTimeout(time.Minute), WithUnorderedKey("unordered", 2),
+		WithOnComplete(func(string, time.Duration) { atomic.AddInt32(&completed, 1) }))
+	block := make(chan struct{})
+	parent.Submit(wrk{k: "key", d: func() { <-block }})
+
+	child := parent.WithSameOptions()
+	assert.Equal(t, parent.cfg.idleTimeout, child.cfg.idleTimeout)
+	child.Submit(wrk{k: "key", d: func() { <-block }})
+	child.Submit(wrk{k: "other", d: func() {}})
+	assert.Equal(t, uint64(1), parent.QueueLen())
+	assert.Equal(t, []string{"key"}, parent.Keys())
+
+	// shutting one down leaves the other alone
+	close(block)
+	assert.NoError(t, child.Shutdown(context.Background()))
+	parent.Submit(wrk{k: "key", d: func() {}})
+	assert.NoError(t, parent.Shutdown(context.Background()))
+	// the handler is shared
+	assert.Equal(t, int32(4), atomic.LoadInt32(&completed))
+}
+
+func TestOldestPendingAge(t *testing.T) {
+	sut := New()
+	assert.Equal(t, time.Duration(0), sut.OldestPendingAge())
+	sut.Pause("a")
+	sut.Pause("b")
+	start := time.Now()
+	sut.Submit(wrk{k: "a", d: func() {}})
+	time.Sleep(50 * time.Millisecond)
+	sut.Submit(wrk{k: "b", d: func() {}})
+	sut.Submit(wrk{k: "a", d: func() {}})
+
+	age := sut.OldestPendingAge()
+	assert.GreaterOrEqual(t, age, 50*time.Millisecond)
+	assert.LessOrEqual(t, age, time.Since(start))
+
+	// once a's items have gone, b's is the oldest
+	sut.Resume("a")
+	assert.Eventually(t, func() bool { return sut.KeyQueueLen("a") == 0 }, time.Second, time.Millisecond)
+	assert.Less(t, sut.OldestPendingAge(), age)
+	sut.Resume("b")
+	sut.Wait()
+	assert.Equal(t, time.Duration(0), sut.OldestPendingAge())
+}
+
+func TestPeekKey(t *testing.T) {
+	sut := New()
+	var ran []string
+	item := func(id string) dedupeWrk {
+		return dedupeWrk{wrk: wrk{k: "key", d: func() { ran = append(ran, id) }}, id: id}
+	}
+	sut.Pause("key")
+	sut.Submit(item("oldest"))
+	sut.Submit(item("newest"))
+
+	head, ok := sut.PeekKey("key")
+	if assert.True(t, ok) {
+		assert.Equal(t, "oldest", head.(dedupeWrk).id)
+	}
+	// peeking doesn't take the work
+	head, _ = sut.PeekKey("key")
+	assert.Equal(t, "oldest", head.(dedupeWrk).id)
+	_, ok = sut.PeekKey("unknown")
+	assert.False(t, ok)
+
+	assert.False(t, sut.ReplaceHead("key", wrk{k: "other"}))
+	assert.False(t, sut.ReplaceHead("unknown", wrk{k: "unknown"}))
+	assert.PanicsWithValue(t, ErrNilWork, func() { sut.ReplaceHead("key", nil) })
+	assert.True(t, sut.ReplaceHead("key", item("replacement")))
+	sut.Resume("key")
+	sut.Wait()
+	assert.Equal(t, []string{"replacement", "newest"}, ran)
+
+	// a key whose only work is running has nothing queued
+	block := make(chan struct{})
+	started := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	_, ok = sut.PeekKey("key")
+	assert.False(t, ok)
+	assert.False(t, sut.ReplaceHead("key", item("late")))
+	close(block)
+	sut.Wait()
+}
+
+func TestPause(t *testing.T) {
+	sut := New(WithIdleTimeout(5 * time.Millisecond))
+	sut.Pause("key")
+	sut.Pause("key")
+	var ran []int
+	for i := 0; i < 5; i++ {
+		sut.Submit(wrk{k: "key", d: func() { ran = append(ran, i) }})
+	}
+	// other keys are unaffected
+	done := make(chan struct{})
+	sut.Submit(wrk{k: "other", d: func() { close(done) }})
+	<-done
+
+	// several idle timeouts pass without the manager giving up on the held work
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, ran)
+	assert.Equal(t, 5, sut.KeyQueueLen("key"))
+	assert.Equal(t, int64(1), sut.Stats().ActiveKeys)
+
+	sut.Resume("key")
+	sut.Resume("key")
+	sut.Wait()
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, ran)
+}
+
+func TestPauseAll(t *testing.T) {
+	sut := New(WithIdleTimeout(5 * time.Millisecond))
+	sut.PauseAll()
+	sut.PauseAll()
+	sut.Pause("held")
+	ran := map[string][]int{}
+	var mtx sync.Mutex
+	for _, key := range []string{"a", "b", "held"} {
+		for i := 0; i < 3; i++ {
+			sut.Submit(wrk{k: key, d: func() {
+				mtx.Lock()
+				defer mtx.Unlock()
+				ran[key] = append(ran[key], i)
+			}})
+		}
+	}
+
+	// several idle timeouts pass without the managers giving up on the held work
+	time.Sleep(50 * time.Millisecond)
+	mtx.Lock()
+	assert.Empty(t, ran)
+	mtx.Unlock()
+	assert.Equal(t, int64(3), sut.Stats().ActiveKeys)
+
+	sut.ResumeAll()
+	sut.ResumeAll()
+	assert.Eventually(t, func() bool {
+		return sut.KeyQueueLen("a") == 0 && sut.KeyQueueLen("b") == 0
+	}, time.Second, time.Millisecond)
+	// the key's own pause outlives the pool's
+	assert.Equal(t, 3, sut.KeyQueueLen("held"))
+
+	sut.Resume("held")
+	sut.Wait()
+	assert.Equal(t, map[string][]int{"a": {0, 1, 2}, "b": {0, 1, 2}, "held": {0, 1, 2}}, ran)
+}
+
+func TestStats(t *testing.T) {
+	sut := New()
+	assert.Equal(t, Stats{}, sut.Stats())
+	block := make(chan struct{})
+	for _, key := range []string{"a", "b", "c"} {
+		sut.Submit(wrk{k: key, d: func() { <-block }})
+	}
+	sut.Submit(wrk{k: "a", d: func() {}})
+
+	assert.Eventually(t, func() bool {
+		return sut.Stats().RunningItems == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, Stats{QueueLen: 4, ActiveKeys: 3, RunningItems: 3, TrackedKeys: 3, RespawnCount: 3}, sut.Stats())
+	close(block)
+	sut.Wait()
+	stats := sut.Stats()
+	assert.Greater(t, stats.Throughput, 0.0)
+	stats.Throughput = 0
+	assert.Equal(t, Stats{RespawnCount: 3}, stats)
+
+	// an idle key is set up afresh
+	sut.Submit(wrk{k: "a", d: func() {}})
+	sut.Wait()
+	assert.Equal(t, uint64(4), sut.Stats().RespawnCount)
+	sut.Reset()
+	assert.Equal(t, Stats{}, sut.Stats())
+}
+
+func TestResetMetrics(t *testing.T) {
+	sut := New(WithKeyThroughput())
+	block := make(chan struct{})
+	for _, key := range []string{"a", "b"} {
+		sut.Submit(wrk{k: key, d: func() {}})
+	}
+	sut.Wait()
+	sut.Submit(wrk{k: "a", d: func() { <-block }})
+	sut.Submit(wrk{k: "a", d: func() {}})
+	assert.Equal(t, uint64(3), sut.Stats().RespawnCount)
+	assert.Greater(t, sut.Stats().Throughput, 0.0)
+
+	// counters start again, while the gauges carry on tracking the work in flight
+	sut.ResetMetrics()
+	stats := sut.Stats()
+	assert.Zero(t, stats.RespawnCount)
+	assert.Zero(t, stats.Throughput)
+	assert.Zero(t, sut.KeyThroughput("b"))
+	assert.Equal(t, uint64(2), stats.QueueLen)
+	assert.Equal(t, 1, sut.NumManagers())
+
+	close(block)
+	sut.Wait()
+	assert.Zero(t, sut.QueueLen())
+	assert.Greater(t, sut.Stats().Throughput, 0.0)
+	sut.Submit(wrk{k: "c", d: func() {}})
+	sut.Wait()
+	assert.Equal(t, uint64(1), sut.Stats().RespawnCount)
+}
+
+func TestWarm(t *testing.T) {
+	sut := New(WithIdleTimeout(50 * time.Millisecond))
+	sut.Warm("a", "b")
+	assert.True(t, sut.IsActive("a"))
+	assert.True(t, sut.IsActive("b"))
+	assert.Equal(t, Stats{ActiveKeys: 2, TrackedKeys: 2, RespawnCount: 2}, sut.Stats())
+
+	// the first work for a warmed key finds its manager waiting
+	ran := make(chan struct{})
+	sut.Submit(wrk{k: "a", d: func() { close(ran) }})
+	<-ran
+	assert.Equal(t, uint64(2), sut.Stats().RespawnCount)
+	assert.Equal(t, int64(2), sut.Stats().TrackedKeys)
+	// warming an active key does nothing
+	sut.Warm("a")
+	assert.Equal(t, uint64(2), sut.Stats().RespawnCount)
+
+	// warmed keys go cold after the idle timeout like any other
+	sut.Wait()
+	assert.False(t, sut.IsActive("a"))
+	assert.False(t, sut.IsActive("b"))
+	assertDrained(t, sut)
+
+	assert.NoError(t, sut.Shutdown(context.Background()))
+	assert.PanicsWithValue(t, ErrPoolClosed, func() { sut.Warm("a") })
+}
+
+func TestStatsIdleRace(t *testing.T) {
+	sut := New(WithIdleTimeout(time.Millisecond))
+	done := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { close(done) }})
+	<-done
+
+	// hold the submit lock so that the manager, once idle, can't retire until work has been queued behind its back
+	sut.submitMtx.Lock()
+	time.Sleep(20 * time.Millisecond)
+	ran := make(chan struct{})
+	sut.submitLocked(entry[string]{work: wrk{k: "key", d: func() { close(ran) }}})
+	sut.submitMtx.Unlock()
+	<-ran
+	sut.Wait()
+
+	// the manager carried on with the work, so no second manager was needed
+	stats := sut.Stats()
+	assert.Equal(t, uint64(1), stats.IdleRaces)
+	assert.Equal(t, uint64(1), stats.RespawnCount)
+}
+
+func TestPurgeKey(t *testing.T) {
+	sut := New()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran int32
+	sut.Submit(wrk{k: "key", d: func() {
+		close(started)
+		<-block
+		atomic.AddInt32(&ran, 1)
+	}})
+	<-started
+	for i := 0; i < 5; i++ {
+		sut.Submit(wrk{k: "key", d: func() { atomic.AddInt32(&ran, 1) }})
+	}
+	sut.Submit(wrk{k: "other", d: func() { <-block }})
+
+	assert.Equal(t, 5, sut.PurgeKey("key"))
+	assert.Equal(t, 0, sut.PurgeKey("unknown"))
+	assert.Equal(t, uint64(2), sut.QueueLen())
+	close(block)
+	sut.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ran))
+
+	// the key carries on as normal afterwards
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	sut.Submit(wrk{k: "key", d: wg.Done})
+	wg.Wait()
+}
+
+func TestSubmitCancel(t *testing.T) {
+	for name, sut := range map[string]*Workpool{
+		"built-in queue": New(),
+		// a Queue can't be spliced, so cancelled work is dropped when it reaches the head
+		"custom queue": New(WithQueueFactory(func(string) Queue { return &fifoQueue{} })),
+	} {
+		block := make(chan struct{})
+		started := make(chan struct{})
+		var mtx sync.Mutex
+		var ran []int
+		record := func(i int) func() {
+			return func() {
+				mtx.Lock()
+				defer mtx.Unlock()
+				ran = append(ran, i)
+			}
+		}
+		cancelStarted := sut.Submit(wrk{k: "key", d: func() {
+			close(started)
+			<-block
+			record(0)()
+		}})
+		<-started
+		var cancels []func() bool
+		for i := 1; i <= 3; i++ {
+			cancels = append(cancels, sut.Submit(wrk{k: "key", d: record(i)}))
+		}
+
+		assert.False(t, cancelStarted(), name)
+		assert.True(t, cancels[1](), name)
+		assert.False(t, cancels[1](), name)
+		if name == "built-in queue" {
+			assert.Equal(t, uint64(3), sut.QueueLen(), name)
+		}
+		close(block)
+		sut.Wait()
+		assert.Equal(t, []int{0, 1, 3}, ran, name)
+		assert.Zero(t, sut.QueueLen(), name)
+		// finished work can't be cancelled
+		assert.False(t, cancels[0](), name)
+	}
+}
+
+func TestSubmitCancelNotQueued(t *testing.T) {
+	// work which was dropped or replaced has nothing left to cancel
+	sut := New(WithDropWhileBusy())
+	block := make(chan struct{})
+	sut.Submit(wrk{k: "key", d: func() { <-block }})
+	assert.False(t, sut.Submit(wrk{k: "key", d: func() {}})())
+	close(block)
+	sut.Wait()
+
+	sut = New(WithDedupe())
+	sut.Pause("key")
+	var ran []string
+	item := func(id string) dedupeWrk {
+		return dedupeWrk{wrk: wrk{k: "key", d: func() { ran = append(ran, id) }}, id: id}
+	}
+	cancelReplaced := sut.Submit(item("replaced"))
+	cancelReplacement := sut.Submit(item("replaced"))
+	assert.False(t, cancelReplaced())
+	assert.True(t, cancelReplacement())
+
+	cancelHead := sut.Submit(item("head"))
+	assert.True(t, sut.ReplaceHead("key", item("replacement")))
+	assert.False(t, cancelHead())
+	sut.Resume("key")
+	sut.Wait()
+	assert.Equal(t, []string{"replacement"}, ran)
+}
+
+func TestPurgeKeyRacingManager(t *testing.T) {
+	sut := New()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 3; j++ {
+			sut.Submit(wrk{k: "key", d: func() {}})
+		}
+		sut.PurgeKey("key")
+	}
+	sut.Wait()
+	assert.Equal(t, uint64(0), sut.QueueLen())
+	wg.Add(1)
+	sut.Submit(wrk{k: "key", d: wg.Done})
+	wg.Wait()
+}
+
+type tenantKey struct {
+	tenant string
+	entity int
+}
+
+type tenantWrk struct {
+	k tenantKey
+	d func()
+	p int
+}
+
+func (w tenantWrk) Key() tenantKey {
+	return w.k
+}
+
+func (w tenantWrk) Do() {
+	w.d()
+}
+
+func (w tenantWrk) Priority() int {
+	return w.p
+}
+
+func TestKeyedWorkpool(t *testing.T) {
+	var mtx sync.Mutex
+	var idle []tenantKey
+	sut := NewKeyed[tenantKey](WithOnKeyIdle(func(key tenantKey) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		idle = append(idle, key)
+	}))
+	a1, a2 := tenantKey{tenant: "a", entity: 1}, tenantKey{tenant: "a", entity: 2}
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran []string
+	sut.Submit(tenantWrk{k: a1, d: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+	sut.Submit(tenantWrk{k: a1, d: func() { ran = append(ran, "low") }})
+	// work for other key types is recognized by its methods, just as for string keys
+	sut.Submit(tenantWrk{k: a1, d: func() { ran = append(ran, "high") }, p: 1})
+	// a key which differs in one field is another key, so it isn't held up
+	other := make(chan struct{})
+	sut.SubmitFunc(a2, func() { close(other) })
+	<-other
+	assert.Contains(t, sut.Keys(), a1)
+	assert.Equal(t, 2, sut.Snapshot()[a1])
+
+	close(block)
+	assert.Equal(t, "done", <-SubmitValue(sut, a1, func() string { return "done" }))
+	sut.Wait()
+	assert.Equal(t, []string{"high", "low"}, ran)
+	assert.ElementsMatch(t, []tenantKey{a1, a2}, idle)
+
+	// options are checked against the pool's type of key
+	assert.Panics(t, func() { NewKeyed[tenantKey](WithOnKeyIdle(func(string) {})) })
+	assert.Panics(t, func() { New(WithUnorderedKey(a1, 2)) })
+}
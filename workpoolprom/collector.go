@@ -0,0 +1,52 @@
+// Package workpoolprom reports a workpool's gauges to Prometheus.  It's kept apart from the workpool package so that
+// the workpool itself doesn't depend on the Prometheus client
+package workpoolprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/raidancampbell/go-workpool"
+)
+
+var (
+	queueLenDesc = prometheus.NewDesc("workpool_queue_length",
+		"Submitted items which have not yet finished, including any that are running", nil, nil)
+	trackedKeysDesc = prometheus.NewDesc("workpool_tracked_keys",
+		"Keys the workpool is tracking", nil, nil)
+	activeKeysDesc = prometheus.NewDesc("workpool_active_keys",
+		"Keys with a running management goroutine", nil, nil)
+	runningItemsDesc = prometheus.NewDesc("workpool_running_items",
+		"Items executing right now", nil, nil)
+	keyQueueDepthDesc = prometheus.NewDesc("workpool_key_queue_depth",
+		"Items waiting to run for each tracked key", []string{"key"}, nil)
+)
+
+// collector reads the workpool's gauges on each scrape
+type collector struct {
+	wp *workpool.Workpool
+}
+
+// NewCollector returns a prometheus.Collector reporting the given workpool's Stats, along with the queue depth of each
+// tracked key.  Everything is read when the collector is scraped.  The per-key gauge has a series for every tracked
+// key, so beware of registering it for a workpool with unbounded key cardinality
+func NewCollector(wp *workpool.Workpool) prometheus.Collector {
+	return collector{wp: wp}
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLenDesc
+	ch <- trackedKeysDesc
+	ch <- activeKeysDesc
+	ch <- runningItemsDesc
+	ch <- keyQueueDepthDesc
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.wp.Stats()
+	ch <- prometheus.MustNewConstMetric(queueLenDesc, prometheus.GaugeValue, float64(stats.QueueLen))
+	ch <- prometheus.MustNewConstMetric(trackedKeysDesc, prometheus.GaugeValue, float64(stats.TrackedKeys))
+	ch <- prometheus.MustNewConstMetric(activeKeysDesc, prometheus.GaugeValue, float64(stats.ActiveKeys))
+	ch <- prometheus.MustNewConstMetric(runningItemsDesc, prometheus.GaugeValue, float64(stats.RunningItems))
+	for key, depth := range c.wp.Snapshot() {
+		ch <- prometheus.MustNewConstMetric(keyQueueDepthDesc, prometheus.GaugeValue, float64(depth), key)
+	}
+}
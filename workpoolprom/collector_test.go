@@ -0,0 +1,46 @@
+package workpoolprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/raidancampbell/go-workpool"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	wp := workpool.New()
+	block := make(chan struct{})
+	started := make(chan struct{})
+	wp.SubmitFunc("a", func() {
+		close(started)
+		<-block
+	})
+	<-started
+	wp.SubmitFunc("a", func() {})
+	wp.SubmitFunc("a", func() {})
+
+	c := NewCollector(wp)
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(c))
+	// the four pool-wide gauges, and the depth of the one key
+	assert.Equal(t, 5, testutil.CollectAndCount(c))
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP workpool_key_queue_depth Items waiting to run for each tracked key
+# TYPE workpool_key_queue_depth gauge
+workpool_key_queue_depth{key="a"} 2
+# HELP workpool_queue_length Submitted items which have not yet finished, including any that are running
+# TYPE workpool_queue_length gauge
+workpool_queue_length 3
+# HELP workpool_running_items Items executing right now
+# TYPE workpool_running_items gauge
+workpool_running_items 1
+`), "workpool_key_queue_depth", "workpool_queue_length", "workpool_running_items"))
+
+	close(block)
+	wp.Wait()
+	// the idle key is no longer tracked
+	assert.Equal(t, 4, testutil.CollectAndCount(c))
+	assert.Equal(t, 0, testutil.CollectAndCount(c, "workpool_key_queue_depth"))
+}